@@ -0,0 +1,200 @@
+package main
+
+import (
+	"eximmon/whm"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accountRefresh is how long the domain to cPanel account map of WHM is used
+// before it is read again
+var accountRefresh = time.Hour
+
+// accountLookup is how often WHM is asked for the domains missing from the map
+var accountLookup = time.Minute
+
+// accountDomains maps the domains of the server to their cPanel account. It is
+// kept up to date by refresh in the background, counting only reads it.
+type accountDomains struct {
+	mu      sync.Mutex
+	users   map[string]string
+	whm     bool            // users came from WHM, so unknown domains may be asked for
+	missing map[string]bool // domains counted but not in users, for refresh to ask for
+}
+
+var accounts = &accountDomains{users: map[string]string{}, missing: map[string]bool{}}
+
+// accountsEnabled reports whether any account limit is set, accounts are not
+// looked up otherwise
+func accountsEnabled(limits scanLimits) bool {
+	return limits.AccountMaxPerMin > 0 || limits.AccountMaxPerHour > 0 || limits.AccountMaxPerDay > 0
+}
+
+// accountKey is the name the totals of a cPanel account are stored under
+func accountKey(user string) string {
+	return "account:" + user
+}
+
+// account returns the cPanel account a sender belongs to, empty when the
+// domain of its mailbox is not on this server or not known yet
+func (a *accountDomains) account(sender senderIdentity) string {
+	if sender.User != "" {
+		return sender.User
+	}
+	domain, err := emailDomainName(sender.Email)
+	if err != nil {
+		return ""
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	domain = strings.ToLower(domain)
+	user, ok := a.users[domain]
+	if !ok && a.whm {
+		// a domain added since the map was loaded
+		a.missing[domain] = true
+	}
+	return user
+}
+
+// refresh loads the map, then keeps it up to date in the background: read
+// again every accountRefresh and the missing domains asked for in between
+func (a *accountDomains) refresh() {
+	a.load()
+	go func() {
+		loaded := time.Now()
+		for {
+			time.Sleep(accountLookup)
+			if time.Since(loaded) >= accountRefresh {
+				a.load()
+				loaded = time.Now()
+			} else {
+				a.lookupMissing()
+			}
+		}
+	}()
+}
+
+// load reads the domains of WHM, or /etc/userdomains when WHM is unreachable
+func (a *accountDomains) load() {
+	users := map[string]string{}
+	fromWHM := true
+	if domains, err := whm.Domains(); err != nil {
+		log("Unable to list the domains of WHM, reading %s: %v", userDomainsPath, err)
+		users = loadUserDomains(userDomainsPath)
+		fromWHM = false
+	} else {
+		for _, d := range domains {
+			users[strings.ToLower(d.Domain)] = d.User
+		}
+		debugLog("Loaded %d domains of WHM", len(users))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	a.whm = fromWHM
+	a.missing = map[string]bool{}
+}
+
+// lookupMissing asks WHM for the account of the domains not in the map, an
+// empty user is remembered too until the map is read again
+func (a *accountDomains) lookupMissing() {
+	a.mu.Lock()
+	missing := a.missing
+	a.missing = map[string]bool{}
+	a.mu.Unlock()
+
+	for domain := range missing {
+		user := ""
+		if info, err := whm.UserDataInfo(domain); err != nil {
+			debugLog("Unable to find the account of %s: %v", domain, err)
+		} else {
+			user = info.User
+		}
+
+		a.mu.Lock()
+		a.users[domain] = user
+		a.mu.Unlock()
+	}
+}
+
+// countAccount adds a message of sender to the totals of its cPanel account
+// and suspends the account once they are over the account limits
+func countAccount(sender senderIdentity, thetime time.Time, recipients int64, limits scanLimits) error {
+	if !accountsEnabled(limits) {
+		return nil
+	}
+	user := accounts.account(sender)
+	if user == "" {
+		return nil
+	}
+	key := accountKey(user)
+
+	if _, _, err := counterAdd(thetime, key, "", 1); err != nil {
+		return err
+	}
+	if _, _, err := counterAdd(thetime, key, ".rcpt", recipients); err != nil {
+		return err
+	}
+
+	rates.add(key, thetime, recipients, limits.HourWindow)
+	lastMin := rates.count(key, thetime, limits.MinWindow)
+	lastHour := rates.count(key, thetime, limits.HourWindow)
+
+	day := int64(0)
+	if limits.AccountMaxPerDay > 0 {
+		date := time.Date(thetime.Year(), thetime.Month(), thetime.Day(), 0, 0, 0, 0, thetime.Location())
+		var err error
+		if day, err = counterSum(date, thetime, key, ""); err != nil {
+			return err
+		}
+	}
+
+	if !over(lastMin.Messages, limits.AccountMaxPerMin) && !over(lastHour.Messages, limits.AccountMaxPerHour) &&
+		!over(day, limits.AccountMaxPerDay) {
+		return nil
+	}
+
+	message := fmt.Sprintf("Account %s: last %s: %d, last %s: %d, today: %d\nRecipients: last %s: %d, last %s: %d\nLast sender: %s",
+		user, limits.MinWindow, lastMin.Messages, limits.HourWindow, lastHour.Messages, day,
+		limits.MinWindow, lastMin.Recipients, limits.HourWindow, lastHour.Recipients, sender)
+	suspendAccount(sender, user, message)
+	return nil
+}
+
+// suspendAccount queues the suspension of outgoing mail of the whole cPanel
+// account of sender and the notification
+func suspendAccount(sender senderIdentity, user string, message string) {
+	actions.submit(accountKey(user), func() {
+		var err error
+		if sender.Email != "" {
+			err = whm.SuspendAccountByEmail(sender.Email)
+		} else {
+			err = whm.SuspendUser(user)
+		}
+		if err != nil {
+			log("Unable to suspend account %s, error: %+v", user, err)
+			time.Sleep(5 * time.Second)
+		}
+
+		if notifyEmail != "" {
+			if err := notifySuspend("cPanel account "+user, message); err != nil {
+				log("notifySuspend error: %+v", err)
+				time.Sleep(10 * time.Second)
+			}
+		}
+	})
+}
+
+// parseCounterKey reads a sender or account:user given on the command line
+// as the name its counters are stored under
+func parseCounterKey(name string) string {
+	if strings.HasPrefix(name, "account:") {
+		return name
+	}
+	return parseIdentity(name).Key()
+}
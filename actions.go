@@ -0,0 +1,54 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// actions runs suspensions, blocks and notifications off the scan goroutine
+var actions *actionQueue
+
+// actionQueue runs actions on a bounded pool of workers. Actions of one key,
+// e.g. a sender, always go to the same worker so they run in order, and
+// submit blocks while that worker's queue is full.
+type actionQueue struct {
+	workers []chan func()
+	pending sync.WaitGroup
+}
+
+func newActionQueue(workers int, size int) *actionQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &actionQueue{workers: make([]chan func(), workers)}
+	for i := range q.workers {
+		q.workers[i] = make(chan func(), size)
+		go q.run(q.workers[i])
+	}
+	return q
+}
+
+func (q *actionQueue) run(queue chan func()) {
+	for action := range queue {
+		action()
+		q.pending.Done()
+	}
+}
+
+// submit queues action behind the earlier actions of key
+func (q *actionQueue) submit(key string, action func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := q.workers[h.Sum32()%uint32(len(q.workers))]
+
+	q.pending.Add(1)
+	if len(queue) == cap(queue) {
+		debugLog("Action queue full, waiting for %s", key)
+	}
+	queue <- action
+}
+
+// wait blocks until every submitted action has run
+func (q *actionQueue) wait() {
+	q.pending.Wait()
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"eximmon/exim"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// userDomainsPath maps domains to cPanel accounts, read by analyze instead of asking WHM
+var userDomainsPath = "/etc/userdomains"
+
+// analyzeCounts are the volumes of a sender, domain or account in a log
+type analyzeCounts struct {
+	Messages       int64    `json:"messages"`
+	Recipients     int64    `json:"recipients"` // external only
+	Delivered      int64    `json:"delivered"`
+	Deferred       int64    `json:"deferred"`
+	Failed         int64    `json:"failed"`
+	MaxPerMin      int64    `json:"max_per_min"`
+	MaxPerHour     int64    `json:"max_per_hour"`
+	MaxRcptPerMin  int64    `json:"max_rcpt_per_min"`
+	MaxRcptPerHour int64    `json:"max_rcpt_per_hour"`
+	Violations     []string `json:"violations,omitempty"`
+
+	buckets map[string]int64 // message and recipient counts per minute and hour
+}
+
+// analyzeReport is the result of eximmon analyze
+type analyzeReport struct {
+	From     time.Time                 `json:"from"`
+	To       time.Time                 `json:"to"`
+	Lines    int64                     `json:"lines"`
+	Senders  map[string]*analyzeCounts `json:"senders"`
+	Domains  map[string]*analyzeCounts `json:"domains"`
+	Accounts map[string]*analyzeCounts `json:"accounts"`
+}
+
+// logAnalyzer counts a log in memory only, it never writes data/ or calls WHM
+type logAnalyzer struct {
+	report      analyzeReport
+	limits      scanLimits
+	messages    *exim.Tracker
+	rates       *rateTracker
+	failures    *failureTracker
+	userDomains map[string]string
+}
+
+func newLogAnalyzer(limits scanLimits) *logAnalyzer {
+	return &logAnalyzer{
+		report: analyzeReport{
+			Senders:  map[string]*analyzeCounts{},
+			Domains:  map[string]*analyzeCounts{},
+			Accounts: map[string]*analyzeCounts{},
+		},
+		limits:      limits,
+		messages:    exim.NewTracker(24 * time.Hour),
+		rates:       newRateTracker(),
+		failures:    newFailureTracker(),
+		userDomains: loadUserDomains(userDomainsPath),
+	}
+}
+
+// loadUserDomains reads the "domain: user" lines of cPanel's /etc/userdomains
+func loadUserDomains(path string) map[string]string {
+	domains := map[string]string{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		debugLog("Unable to read %s, accounts of mailboxes are unknown: %v", path, err)
+		return domains
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) != "" {
+			domains[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return domains
+}
+
+func (a *logAnalyzer) counts(group map[string]*analyzeCounts, key string) *analyzeCounts {
+	c, ok := group[key]
+	if !ok {
+		c = &analyzeCounts{buckets: map[string]int64{}}
+		group[key] = c
+	}
+	return c
+}
+
+// add counts a line the same way countEntry and countOutcome do
+func (a *logAnalyzer) add(text string) {
+	entry, _, err := exim.ParseLineWith(text, logPatterns)
+	if err != nil {
+		return
+	}
+	a.report.Lines++
+	if a.report.From.IsZero() || entry.Time.Before(a.report.From) {
+		a.report.From = entry.Time
+	}
+	if entry.Time.After(a.report.To) {
+		a.report.To = entry.Time
+	}
+
+	msg, first := a.messages.Add(entry)
+	if msg != nil && entry.Flag != exim.FlagArrival {
+		a.addOutcome(entry, msg, first)
+		return
+	}
+
+	sender, ok := outboundIdentity(entry)
+	if !ok {
+		return
+	}
+	domain, _ := sender.senderDomain(entry)
+
+	external := int64(0)
+	for _, rec := range entry.Recipients {
+		if recipientDomain, err := emailDomainName(rec); err == nil && recipientDomain != domain {
+			external++
+		}
+	}
+	if external == 0 {
+		return
+	}
+
+	minute := entry.Time.Format("2006-01-02 15:04")
+	hour := entry.Time.Format("2006-01-02 15")
+	for _, c := range a.groups(sender, domain) {
+		c.Messages++
+		c.Recipients += external
+		c.MaxPerMin = max(c.MaxPerMin, c.bucket("msg "+minute, 1))
+		c.MaxPerHour = max(c.MaxPerHour, c.bucket("msg "+hour, 1))
+		c.MaxRcptPerMin = max(c.MaxRcptPerMin, c.bucket("rcpt "+minute, external))
+		c.MaxRcptPerHour = max(c.MaxRcptPerHour, c.bucket("rcpt "+hour, external))
+	}
+
+	// sender limits only over the sliding windows countEntry uses, a violation
+	// is reported when a window goes over its limit, not again while it stays over
+	key := sender.Key()
+	c := a.report.Senders[key]
+	prevMin := a.rates.count(key, entry.Time, a.limits.MinWindow)
+	prevHour := a.rates.count(key, entry.Time, a.limits.HourWindow)
+	a.rates.add(key, entry.Time, external, a.limits.HourWindow)
+	lastMin := a.rates.count(key, entry.Time, a.limits.MinWindow)
+	lastHour := a.rates.count(key, entry.Time, a.limits.HourWindow)
+
+	at := entry.Time.Format("2006-01-02 15:04:05")
+	crossed := func(prev int64, last int64, limit int64) bool {
+		return limit > 0 && prev <= limit && last > limit
+	}
+	if crossed(prevMin.Messages, lastMin.Messages, int64(a.limits.MaxPerMin)) {
+		c.violation("%s: %d messages in %s", at, lastMin.Messages, a.limits.MinWindow)
+	}
+	if crossed(prevHour.Messages, lastHour.Messages, int64(a.limits.MaxPerHour)) {
+		c.violation("%s: %d messages in %s", at, lastHour.Messages, a.limits.HourWindow)
+	}
+	if crossed(prevMin.Recipients, lastMin.Recipients, a.limits.MaxRcptPerMin) {
+		c.violation("%s: %d recipients in %s", at, lastMin.Recipients, a.limits.MinWindow)
+	}
+	if crossed(prevHour.Recipients, lastHour.Recipients, a.limits.MaxRcptPerHour) {
+		c.violation("%s: %d recipients in %s", at, lastHour.Recipients, a.limits.HourWindow)
+	}
+
+	// calendar quotas, the counts of the day, week and month are kept with the buckets
+	year, week := entry.Time.ISOWeek()
+	for _, q := range []struct {
+		period string
+		bucket string
+		limit  int64
+	}{
+		{"day", "day " + entry.Time.Format("2006-01-02"), a.limits.MaxPerDay},
+		{"week", fmt.Sprintf("week %d-%02d", year, week), a.limits.MaxPerWeek},
+		{"month", "month " + entry.Time.Format("2006-01"), a.limits.MaxPerMonth},
+	} {
+		if count := c.bucket(q.bucket, 1); q.limit > 0 && count == q.limit+1 {
+			c.violation("%s: %d messages this %s", at, count, q.period)
+		}
+	}
+
+	// domain limits apply to the totals of all mailboxes of the domain
+	if domain != "" {
+		limit := a.limits.domainLimit(domain)
+		key = domainKey(domain)
+		c = a.report.Domains[domain]
+		prevMin = a.rates.count(key, entry.Time, a.limits.MinWindow)
+		prevHour = a.rates.count(key, entry.Time, a.limits.HourWindow)
+		a.rates.add(key, entry.Time, external, a.limits.HourWindow)
+		lastMin = a.rates.count(key, entry.Time, a.limits.MinWindow)
+		lastHour = a.rates.count(key, entry.Time, a.limits.HourWindow)
+		if crossed(prevMin.Messages, lastMin.Messages, limit.MaxPerMin) {
+			c.violation("%s: %d messages in %s", at, lastMin.Messages, a.limits.MinWindow)
+		}
+		if crossed(prevHour.Messages, lastHour.Messages, limit.MaxPerHour) {
+			c.violation("%s: %d messages in %s", at, lastHour.Messages, a.limits.HourWindow)
+		}
+		if count := c.bucket("day "+entry.Time.Format("2006-01-02"), 1); limit.MaxPerDay > 0 && count == limit.MaxPerDay+1 {
+			c.violation("%s: %d messages this day", at, count)
+		}
+	}
+
+	// account limits apply to the totals of all senders of the account
+	account := a.account(sender, domain)
+	if account == "" {
+		return
+	}
+	key = accountKey(account)
+	c = a.report.Accounts[account]
+	prevMin = a.rates.count(key, entry.Time, a.limits.MinWindow)
+	prevHour = a.rates.count(key, entry.Time, a.limits.HourWindow)
+	a.rates.add(key, entry.Time, external, a.limits.HourWindow)
+	lastMin = a.rates.count(key, entry.Time, a.limits.MinWindow)
+	lastHour = a.rates.count(key, entry.Time, a.limits.HourWindow)
+	if crossed(prevMin.Messages, lastMin.Messages, a.limits.AccountMaxPerMin) {
+		c.violation("%s: %d messages in %s", at, lastMin.Messages, a.limits.MinWindow)
+	}
+	if crossed(prevHour.Messages, lastHour.Messages, a.limits.AccountMaxPerHour) {
+		c.violation("%s: %d messages in %s", at, lastHour.Messages, a.limits.HourWindow)
+	}
+	if count := c.bucket("day "+entry.Time.Format("2006-01-02"), 1); a.limits.AccountMaxPerDay > 0 && count == a.limits.AccountMaxPerDay+1 {
+		c.violation("%s: %d messages this day", at, count)
+	}
+}
+
+// addOutcome counts the delivery result of an external recipient
+func (a *logAnalyzer) addOutcome(entry exim.LogEntry, msg *exim.Message, first bool) {
+	if !first {
+		return
+	}
+	sender, ok := outboundIdentity(msg.Arrival)
+	if !ok {
+		return
+	}
+	domain, _ := sender.senderDomain(msg.Arrival)
+	if recipientDomain, err := emailDomainName(entry.Address); err == nil && recipientDomain == domain {
+		return
+	}
+
+	suffix := ""
+	switch entry.Flag {
+	case exim.FlagDelivery, exim.FlagCopy, exim.FlagCutthru:
+		suffix = suffixDelivered
+	case exim.FlagDeferred:
+		suffix = suffixDeferred
+	case exim.FlagFailed:
+		suffix = suffixFailed
+	default:
+		return
+	}
+	for _, c := range a.groups(sender, domain) {
+		switch suffix {
+		case suffixDeferred:
+			c.Deferred++
+		case suffixFailed:
+			c.Failed++
+		default:
+			c.Delivered++
+		}
+	}
+
+	if a.limits.MaxFailureRatio <= 0 {
+		return
+	}
+	for _, changed := range a.failures.outcome(sender, msg.ID+" "+entry.Address, entry.Time, suffix, a.limits.FailureWindow) {
+		key := changed.Key()
+		failed, total := a.failures.count(key)
+		if total < a.limits.FailureMinSample || float64(failed)/float64(total) <= a.limits.MaxFailureRatio {
+			continue
+		}
+		if last, ok := a.failures.suspended[key]; ok && entry.Time.Sub(last) < a.limits.FailureWindow {
+			continue
+		}
+		a.failures.suspended[key] = entry.Time
+		a.counts(a.report.Senders, key).violation("%s: %d of %d recipients bounced or still deferred after %s",
+			entry.Time.Format("2006-01-02 15:04"), failed, total, a.limits.FailureWindow)
+	}
+}
+
+// groups returns the counts of the sender, its domain and its account
+func (a *logAnalyzer) groups(sender senderIdentity, domain string) []*analyzeCounts {
+	groups := []*analyzeCounts{a.counts(a.report.Senders, sender.Key())}
+	if domain != "" {
+		groups = append(groups, a.counts(a.report.Domains, domain))
+	}
+
+	if account := a.account(sender, domain); account != "" {
+		groups = append(groups, a.counts(a.report.Accounts, account))
+	}
+	return groups
+}
+
+// account is the cPanel account of the sender, from /etc/userdomains
+func (a *logAnalyzer) account(sender senderIdentity, domain string) string {
+	if sender.User != "" {
+		return sender.User
+	}
+	return a.userDomains[domain]
+}
+
+func (c *analyzeCounts) bucket(key string, n int64) int64 {
+	c.buckets[key] += n
+	return c.buckets[key]
+}
+
+func (c *analyzeCounts) violation(format string, args ...interface{}) {
+	c.Violations = append(c.Violations, fmt.Sprintf(format, args...))
+}
+
+// analyzeLog reads a log, - for stdin, and prints its report as a table or json
+func analyzeLog(path string, limits scanLimits, asJSON bool) error {
+	analyzer := newLogAnalyzer(limits)
+
+	if path == "-" {
+		reader := bufio.NewReaderSize(os.Stdin, 64*1024)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				analyzer.add(strings.TrimRight(line, "\r\n"))
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	} else if err := readLogArchive(path, func(text string, lineNo int64) error {
+		analyzer.add(text)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(analyzer.report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	report := analyzer.report
+	fmt.Printf("%d lines from %s to %s\n", report.Lines, report.From.Format(time.RFC3339), report.To.Format(time.RFC3339))
+	printAnalyzeTable("sender", report.Senders)
+	printAnalyzeTable("domain", report.Domains)
+	printAnalyzeTable("account", report.Accounts)
+	return nil
+}
+
+// printAnalyzeTable prints counts by volume, then the would-be violations
+func printAnalyzeTable(title string, group map[string]*analyzeCounts) {
+	keys := make([]string, 0, len(group))
+	for key := range group {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if group[keys[i]].Messages == group[keys[j]].Messages {
+			return keys[i] < keys[j]
+		}
+		return group[keys[i]].Messages > group[keys[j]].Messages
+	})
+
+	fmt.Println()
+	fmt.Printf("%-40s %8s %8s %10s %9s %7s %8s %8s %10s\n", title, "sent", "rcpt", "delivered", "deferred", "failed", "max/min", "max/hour", "violations")
+	for _, key := range keys {
+		c := group[key]
+		fmt.Printf("%-40s %8d %8d %10d %9d %7d %8d %8d %10d\n", key, c.Messages, c.Recipients, c.Delivered, c.Deferred, c.Failed, c.MaxPerMin, c.MaxPerHour, len(c.Violations))
+	}
+	for _, key := range keys {
+		for _, v := range group[key].Violations {
+			fmt.Printf("  %s would be suspended at %s\n", key, v)
+		}
+	}
+}
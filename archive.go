@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveReader is a decompressed view of a rotated log
+type archiveReader struct {
+	io.Reader
+	close func() error
+}
+
+func (r *archiveReader) Close() error {
+	return r.close()
+}
+
+// eofReader records whether its reader was read to the end
+type eofReader struct {
+	io.Reader
+	eof bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// archiveSuffixReg matches what logrotate appends to a rotated log: .1 or
+// -20240101, optionally compressed
+var archiveSuffixReg = regexp.MustCompile(`^(\.[0-9]+|-[0-9]{8})(\.gz|\.bz2|\.xz)?$`)
+
+// logArchives returns the rotated copies of logFile (exim_mainlog.1,
+// exim_mainlog-20240101.gz, ...) last written at or after since, oldest first.
+// The live log itself is not included.
+func logArchives(logFile string, since time.Time) ([]string, error) {
+	dir := filepath.Dir(logFile)
+	base := filepath.Base(logFile)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type archive struct {
+		path    string
+		modTime time.Time
+	}
+	archives := []archive{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || !archiveSuffixReg.MatchString(name[len(base):]) || !entry.Type().IsRegular() {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if !since.IsZero() && fi.ModTime().Before(since) {
+			debugLog("archive %s older than %s", name, since.Format(time.RFC3339))
+			continue
+		}
+		archives = append(archives, archive{path: filepath.Join(dir, name), modTime: fi.ModTime()})
+	}
+
+	sort.SliceStable(archives, func(i, j int) bool {
+		if archives[i].modTime.Equal(archives[j].modTime) {
+			return archives[i].path < archives[j].path
+		}
+		return archives[i].modTime.Before(archives[j].modTime)
+	})
+
+	paths := make([]string, 0, len(archives))
+	for _, a := range archives {
+		paths = append(paths, a.path)
+	}
+	return paths, nil
+}
+
+// openLogArchive opens a rotated log, decompressing gzip, bzip2 and xz archives
+func openLogArchive(path string) (io.ReadCloser, error) {
+	if strings.HasSuffix(path, ".xz") {
+		// no xz support in the standard library, use the system tool
+		cmd := exec.Command("xz", "-dc", path)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("unable to run xz for %s: %v", path, err)
+		}
+		reader := &eofReader{Reader: out}
+		return &archiveReader{Reader: reader, close: func() error {
+			if !reader.eof {
+				// stopped early, xz would block writing to the full pipe
+				out.Close()
+				cmd.Wait()
+				return nil
+			}
+			return cmd.Wait()
+		}}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("unable to read gzip %s: %v", path, err)
+		}
+		return &archiveReader{Reader: gz, close: func() error {
+			gz.Close()
+			return file.Close()
+		}}, nil
+	case strings.HasSuffix(path, ".bz2"):
+		return &archiveReader{Reader: bzip2.NewReader(file), close: file.Close}, nil
+	default:
+		return file, nil
+	}
+}
+
+// readLogArchive calls fn for each line of a rotated log
+func readLogArchive(path string, fn func(text string, lineNo int64) error) error {
+	reader, err := openLogArchive(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	buf := bufio.NewReaderSize(reader, 64*1024)
+	lineNo := int64(0)
+	for {
+		line, err := buf.ReadString('\n')
+		if line != "" {
+			lineNo++
+			if err := fn(strings.TrimRight(line, "\r\n"), lineNo); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read %s: %v", path, err)
+		}
+	}
+}
+
+// scanLogArchives counts every rotated log written since startTime, so a rerun
+// covers what logrotate already moved away from the live log
+func scanLogArchives(logFile string, startTime time.Time, limits scanLimits) error {
+	archives, err := logArchives(logFile, startTime)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range archives {
+		log("Scanning archive %s", path)
+		err := readLogArchive(path, func(text string, lineNo int64) error {
+			debugLog("raw line %d: %v", lineNo, text)
+			return countLogLine(text, lineNo, startTime, limits)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
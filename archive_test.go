@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLogArchiveXzStop(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not installed")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exim_mainlog.1.xz")
+
+	// far more than a pipe holds, so xz is still writing when reading stops
+	log := strings.Repeat("2024-03-05 10:20:30 1rAbCd-000123-AB Completed\n", 100000)
+	cmd := exec.Command("xz", "-c")
+	cmd.Stdin = strings.NewReader(log)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	done := make(chan error, 1)
+	go func() {
+		done <- readLogArchive(path, func(text string, lineNo int64) error {
+			return stop
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != stop {
+			t.Errorf("readLogArchive = %v, want the callback error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("readLogArchive hangs after stopping early")
+	}
+}
+
+func TestLogArchives(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"exim_mainlog", "exim_mainlog.1", "exim_mainlog.2.gz", "exim_mainlog-20240301",
+		"exim_mainlog-20240302.bz2", "exim_mainlog-20240303.xz",
+		"exim_mainlog.bak", "exim_mainlog.lock", "exim_mainlog.swp", "exim_mainlog~", "exim_mainlog.1.gz.tmp",
+		"exim_mainlog-2024", "exim_rejectlog.1",
+	}
+	at := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := at.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := logArchives(filepath.Join(dir, "exim_mainlog"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"exim_mainlog.1", "exim_mainlog.2.gz", "exim_mainlog-20240301",
+		"exim_mainlog-20240302.bz2", "exim_mainlog-20240303.xz"}
+	for i := range want {
+		want[i] = filepath.Join(dir, want[i])
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("logArchives = %v, want %v", got, want)
+	}
+}
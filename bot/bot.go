@@ -20,6 +20,10 @@ type Engine struct {
 	mu       sync.RWMutex
 }
 
+// Stats is set by main to answer /stats with the counters of today of a
+// mailbox, cPanel user, account:user, or a domain broken down by mailbox
+var Stats func(name string) (string, error)
+
 // NewEngine creates a new bot engine with config from environment
 func NewEngine() *Engine {
 	config := loadConfigFromEnv()
@@ -182,8 +186,14 @@ func (e *Engine) handleCommand(cmd Command, state *State) string {
 		return sb.String()
 
 	case CmdStats:
-		// TODO: Implement stats lookup from data directory
-		return fmt.Sprintf("📊 Stats for `%s` - Feature coming soon", cmd.Args[0])
+		if Stats == nil {
+			return fmt.Sprintf("❌ Stats for %s are not available", cmd.Args[0])
+		}
+		report, err := Stats(cmd.Args[0])
+		if err != nil {
+			return fmt.Sprintf("❌ Failed to read stats of %s: %v", cmd.Args[0], err)
+		}
+		return report
 
 	case CmdConfig:
 		return fmt.Sprintf("⚙️ *Configuration:*\n• Max Per Min: %d\n• Max Per Hour: %d",
@@ -228,7 +238,7 @@ func (e *Engine) handleCommand(cmd Command, state *State) string {
 		return sb.String()
 
 	default:
-		return "❓ Unknown command. Try /status, /list, /suspend, /unsuspend, /config, /whitelist"
+		return "❓ Unknown command. Try /status, /list, /stats, /suspend, /unsuspend, /config, /whitelist"
 	}
 }
 
@@ -280,6 +290,26 @@ func (e *Engine) NotifyUnsuspend(email string) error {
 	return err
 }
 
+// NotifyAuthAttack sends failed login alert to all configured platforms
+func (e *Engine) NotifyAuthAttack(info AuthAttackInfo) error {
+	if e == nil {
+		return nil
+	}
+
+	var err error
+	if e.telegram != nil {
+		if e := e.telegram.NotifyAuthAttack(info); e != nil {
+			err = e
+		}
+	}
+	if e.slack != nil {
+		if e := e.slack.NotifyAuthAttack(info); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
 // IsWhitelisted checks if an email is in the whitelist
 func (e *Engine) IsWhitelisted(email string) bool {
 	if e == nil {
@@ -69,6 +69,23 @@ func FormatUnsuspendMessage(email string) string {
 	return "✅ Email unsuspended: `" + email + "`"
 }
 
+// FormatAuthAttackMessage creates notification message for failed login bursts
+func FormatAuthAttackMessage(info AuthAttackInfo) string {
+	var sb strings.Builder
+	sb.WriteString("🔐 *SMTP AUTH BRUTE FORCE*\n\n")
+	if info.IP != "" {
+		sb.WriteString("🖥 IP: `" + info.IP + "`\n")
+	}
+	if info.Mailbox != "" {
+		sb.WriteString("📧 Mailbox: `" + info.Mailbox + "`\n")
+	}
+	sb.WriteString("❌ Failed logins: " + strconv.Itoa(info.Failures) + " in " + info.Window.String() + "\n")
+	if info.Blocked {
+		sb.WriteString("\n✅ Action: *IP BLOCKED*")
+	}
+	return sb.String()
+}
+
 // FormatStatusMessage creates status message
 func FormatStatusMessage(uptime string, suspendedCount int, whitelistCount int) string {
 	var sb strings.Builder
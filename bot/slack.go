@@ -180,3 +180,8 @@ func (b *SlackBot) NotifySuspension(info SuspendedInfo) error {
 func (b *SlackBot) NotifyUnsuspend(email string) error {
 	return b.SendNotification(FormatUnsuspendMessage(email))
 }
+
+// NotifyAuthAttack sends failed login alert
+func (b *SlackBot) NotifyAuthAttack(info AuthAttackInfo) error {
+	return b.SendNotification(FormatAuthAttackMessage(info))
+}
@@ -169,6 +169,11 @@ func (b *TelegramBot) NotifyUnsuspend(email string) error {
 	return b.SendNotification(FormatUnsuspendMessage(email))
 }
 
+// NotifyAuthAttack sends failed login alert
+func (b *TelegramBot) NotifyAuthAttack(info AuthAttackInfo) error {
+	return b.SendNotification(FormatAuthAttackMessage(info))
+}
+
 // GetBotUsername returns the bot's username
 func (b *TelegramBot) GetBotUsername() string {
 	if b == nil || b.api == nil {
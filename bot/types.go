@@ -35,6 +35,15 @@ type SuspendedInfo struct {
 	RatePerHour int
 }
 
+// AuthAttackInfo describes repeated failed SMTP logins
+type AuthAttackInfo struct {
+	IP       string // attacking client, empty for a mailbox alert
+	Mailbox  string // targeted login, empty for an IP alert
+	Failures int
+	Window   time.Duration
+	Blocked  bool
+}
+
 // RuntimeConfig holds adjustable settings
 type RuntimeConfig struct {
 	MaxPerMin  int16
@@ -79,4 +88,5 @@ type Bot interface {
 type Notifier interface {
 	NotifySuspension(info SuspendedInfo) error
 	NotifyUnsuspend(email string) error
+	NotifyAuthAttack(info AuthAttackInfo) error
 }
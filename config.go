@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"eximmon/tools"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,16 +13,65 @@ type AppConfig struct {
 	API_TOKEN           string `json:"api_token"`
 	NOTIFY_EMAIL        string `json:"notify_email,omitempty"`
 	EXIM_LOG            string `json:"exim_log"`
+	LOG_SOURCE          string `json:"log_source,omitempty"`
+	JOURNAL_MATCH       string `json:"journal_match,omitempty"`
+	JOURNAL_FILE        string `json:"journal_file,omitempty"`
+	LOG_TIMEZONE        string `json:"log_timezone,omitempty"`
 	WHM_API_HOST        string `json:"whm_api_host"`
 	PREFER_MODERN_UAPI  string `json:"prefer_modern_uapi"`
+	FOLLOW_MODE         string `json:"follow_mode,omitempty"`
+	CONTAIN_SCRIPTS     string `json:"contain_scripts,omitempty"`
 	MAX_PER_MIN         int16  `json:"max_per_min"`
 	MAX_PER_HOUR        int16  `json:"max_per_hour"`
+	MAX_RCPT_PER_MIN    int64  `json:"max_rcpt_per_min,omitempty"`
+	MAX_RCPT_PER_HOUR   int64  `json:"max_rcpt_per_hour,omitempty"`
+	MIN_WINDOW_SEC      int64  `json:"min_window_sec,omitempty"`
+	HOUR_WINDOW_MIN     int64  `json:"hour_window_min,omitempty"`
+	MAX_PER_DAY         int64  `json:"max_per_day,omitempty"`
+	MAX_PER_WEEK        int64  `json:"max_per_week,omitempty"`
+	MAX_PER_MONTH       int64  `json:"max_per_month,omitempty"`
+	ACCOUNT_MAX_PER_MIN  int64 `json:"account_max_per_min,omitempty"`
+	ACCOUNT_MAX_PER_HOUR int64 `json:"account_max_per_hour,omitempty"`
+	ACCOUNT_MAX_PER_DAY  int64 `json:"account_max_per_day,omitempty"`
+	DOMAIN_MAX_PER_MIN  int64  `json:"domain_max_per_min,omitempty"`
+	DOMAIN_MAX_PER_HOUR int64  `json:"domain_max_per_hour,omitempty"`
+	DOMAIN_MAX_PER_DAY  int64  `json:"domain_max_per_day,omitempty"`
+	MINUTE_RETENTION_DAYS int64 `json:"minute_retention_days,omitempty"`
+	HOUR_RETENTION_DAYS int64  `json:"hour_retention_days,omitempty"`
+	RETENTION_DAYS      int64  `json:"retention_days,omitempty"`
+	MAX_FAILURE_RATIO   string `json:"max_failure_ratio,omitempty"`
+	FAILURE_MIN_SAMPLE  int64  `json:"failure_min_sample,omitempty"`
+	FAILURE_WINDOW_MIN  int64  `json:"failure_window_min,omitempty"`
+	REJECT_LOG          string `json:"reject_log,omitempty"`
+	AUTH_FAIL_MAX_PER_IP int64 `json:"auth_fail_max_per_ip,omitempty"`
+	AUTH_FAIL_MAX_PER_MAILBOX int64 `json:"auth_fail_max_per_mailbox,omitempty"`
+	AUTH_FAIL_WINDOW_MIN int64 `json:"auth_fail_window_min,omitempty"`
+	AUTH_BLOCK_CMD      string `json:"auth_block_cmd,omitempty"`
+	ACTION_WORKERS      int64  `json:"action_workers,omitempty"`
+	ACTION_QUEUE        int64  `json:"action_queue,omitempty"`
 	TELEGRAM_BOT_TOKEN  string `json:"telegram_bot_token,omitempty"`
 	TELEGRAM_ADMIN_IDS  string `json:"telegram_admin_ids,omitempty"`
 	TELEGRAM_NOTIFY_CHAT_ID string `json:"telegram_notify_chat_id,omitempty"`
 	SLACK_BOT_TOKEN     string `json:"slack_bot_token,omitempty"`
 	SLACK_ADMIN_IDS     string `json:"slack_admin_ids,omitempty"`
 	SLACK_NOTIFY_CHANNEL string `json:"slack_notify_channel,omitempty"`
+	PATTERNS            []LogPattern `json:"patterns,omitempty"`
+	DOMAIN_LIMITS       map[string]DomainLimit `json:"domain_limits,omitempty"`
+}
+
+// LogPattern is a named extraction pattern for custom log_selector setups,
+// see exim.Pattern for the group names
+type LogPattern struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+// DomainLimit is the allowance of one sending domain in place of the
+// DOMAIN_MAX_* limits, zero keeps a default and -1 disables it
+type DomainLimit struct {
+	MaxPerMin  int64 `json:"max_per_min,omitempty"`
+	MaxPerHour int64 `json:"max_per_hour,omitempty"`
+	MaxPerDay  int64 `json:"max_per_day,omitempty"`
 }
 
 var (
@@ -66,10 +116,10 @@ func saveConfig(cfg *AppConfig) error {
 
 	// Save to current directory
 	path := appConfigPath
-	if err := os.WriteFile(path, data, 0600); err != nil {
+	if err := tools.WriteFileAtomic(path, data, 0600); err != nil {
 		// Try home directory
 		path = filepath.Join(os.Getenv("HOME"), ".eximmon.conf")
-		if err := os.WriteFile(path, data, 0600); err != nil {
+		if err := tools.WriteFileAtomic(path, data, 0600); err != nil {
 			return fmt.Errorf("failed to save config: %w", err)
 		}
 	}
@@ -99,18 +149,114 @@ func applyConfigToEnv(cfg *AppConfig) {
 	} else {
 		os.Setenv("EXIM_LOG", "/var/log/exim_mainlog")
 	}
+	if os.Getenv("LOG_SOURCE") == "" && cfg.LOG_SOURCE != "" {
+		os.Setenv("LOG_SOURCE", cfg.LOG_SOURCE)
+	}
+	if os.Getenv("JOURNAL_MATCH") == "" && cfg.JOURNAL_MATCH != "" {
+		os.Setenv("JOURNAL_MATCH", cfg.JOURNAL_MATCH)
+	}
+	if os.Getenv("JOURNAL_FILE") == "" && cfg.JOURNAL_FILE != "" {
+		os.Setenv("JOURNAL_FILE", cfg.JOURNAL_FILE)
+	}
+	if os.Getenv("LOG_TIMEZONE") == "" && cfg.LOG_TIMEZONE != "" {
+		os.Setenv("LOG_TIMEZONE", cfg.LOG_TIMEZONE)
+	}
 	if os.Getenv("WHM_API_HOST") == "" && cfg.WHM_API_HOST != "" {
 		os.Setenv("WHM_API_HOST", cfg.WHM_API_HOST)
 	}
 	if os.Getenv("PREFER_MODERN_UAPI") == "" && cfg.PREFER_MODERN_UAPI != "" {
 		os.Setenv("PREFER_MODERN_UAPI", cfg.PREFER_MODERN_UAPI)
 	}
+	if os.Getenv("FOLLOW_MODE") == "" && cfg.FOLLOW_MODE != "" {
+		os.Setenv("FOLLOW_MODE", cfg.FOLLOW_MODE)
+	}
+	if os.Getenv("CONTAIN_SCRIPTS") == "" && cfg.CONTAIN_SCRIPTS != "" {
+		os.Setenv("CONTAIN_SCRIPTS", cfg.CONTAIN_SCRIPTS)
+	}
 	if os.Getenv("MAX_PER_MIN") == "" && cfg.MAX_PER_MIN > 0 {
 		os.Setenv("MAX_PER_MIN", fmt.Sprintf("%d", cfg.MAX_PER_MIN))
 	}
 	if os.Getenv("MAX_PER_HOUR") == "" && cfg.MAX_PER_HOUR > 0 {
 		os.Setenv("MAX_PER_HOUR", fmt.Sprintf("%d", cfg.MAX_PER_HOUR))
 	}
+	if os.Getenv("MAX_RCPT_PER_MIN") == "" && cfg.MAX_RCPT_PER_MIN > 0 {
+		os.Setenv("MAX_RCPT_PER_MIN", fmt.Sprintf("%d", cfg.MAX_RCPT_PER_MIN))
+	}
+	if os.Getenv("MAX_RCPT_PER_HOUR") == "" && cfg.MAX_RCPT_PER_HOUR > 0 {
+		os.Setenv("MAX_RCPT_PER_HOUR", fmt.Sprintf("%d", cfg.MAX_RCPT_PER_HOUR))
+	}
+	if os.Getenv("MIN_WINDOW_SEC") == "" && cfg.MIN_WINDOW_SEC > 0 {
+		os.Setenv("MIN_WINDOW_SEC", fmt.Sprintf("%d", cfg.MIN_WINDOW_SEC))
+	}
+	if os.Getenv("HOUR_WINDOW_MIN") == "" && cfg.HOUR_WINDOW_MIN > 0 {
+		os.Setenv("HOUR_WINDOW_MIN", fmt.Sprintf("%d", cfg.HOUR_WINDOW_MIN))
+	}
+	if os.Getenv("MAX_PER_DAY") == "" && cfg.MAX_PER_DAY > 0 {
+		os.Setenv("MAX_PER_DAY", fmt.Sprintf("%d", cfg.MAX_PER_DAY))
+	}
+	if os.Getenv("MAX_PER_WEEK") == "" && cfg.MAX_PER_WEEK > 0 {
+		os.Setenv("MAX_PER_WEEK", fmt.Sprintf("%d", cfg.MAX_PER_WEEK))
+	}
+	if os.Getenv("MAX_PER_MONTH") == "" && cfg.MAX_PER_MONTH > 0 {
+		os.Setenv("MAX_PER_MONTH", fmt.Sprintf("%d", cfg.MAX_PER_MONTH))
+	}
+	if os.Getenv("ACCOUNT_MAX_PER_MIN") == "" && cfg.ACCOUNT_MAX_PER_MIN > 0 {
+		os.Setenv("ACCOUNT_MAX_PER_MIN", fmt.Sprintf("%d", cfg.ACCOUNT_MAX_PER_MIN))
+	}
+	if os.Getenv("ACCOUNT_MAX_PER_HOUR") == "" && cfg.ACCOUNT_MAX_PER_HOUR > 0 {
+		os.Setenv("ACCOUNT_MAX_PER_HOUR", fmt.Sprintf("%d", cfg.ACCOUNT_MAX_PER_HOUR))
+	}
+	if os.Getenv("ACCOUNT_MAX_PER_DAY") == "" && cfg.ACCOUNT_MAX_PER_DAY > 0 {
+		os.Setenv("ACCOUNT_MAX_PER_DAY", fmt.Sprintf("%d", cfg.ACCOUNT_MAX_PER_DAY))
+	}
+	if os.Getenv("DOMAIN_MAX_PER_MIN") == "" && cfg.DOMAIN_MAX_PER_MIN > 0 {
+		os.Setenv("DOMAIN_MAX_PER_MIN", fmt.Sprintf("%d", cfg.DOMAIN_MAX_PER_MIN))
+	}
+	if os.Getenv("DOMAIN_MAX_PER_HOUR") == "" && cfg.DOMAIN_MAX_PER_HOUR > 0 {
+		os.Setenv("DOMAIN_MAX_PER_HOUR", fmt.Sprintf("%d", cfg.DOMAIN_MAX_PER_HOUR))
+	}
+	if os.Getenv("DOMAIN_MAX_PER_DAY") == "" && cfg.DOMAIN_MAX_PER_DAY > 0 {
+		os.Setenv("DOMAIN_MAX_PER_DAY", fmt.Sprintf("%d", cfg.DOMAIN_MAX_PER_DAY))
+	}
+	if os.Getenv("MINUTE_RETENTION_DAYS") == "" && cfg.MINUTE_RETENTION_DAYS > 0 {
+		os.Setenv("MINUTE_RETENTION_DAYS", fmt.Sprintf("%d", cfg.MINUTE_RETENTION_DAYS))
+	}
+	if os.Getenv("HOUR_RETENTION_DAYS") == "" && cfg.HOUR_RETENTION_DAYS > 0 {
+		os.Setenv("HOUR_RETENTION_DAYS", fmt.Sprintf("%d", cfg.HOUR_RETENTION_DAYS))
+	}
+	if os.Getenv("RETENTION_DAYS") == "" && cfg.RETENTION_DAYS > 0 {
+		os.Setenv("RETENTION_DAYS", fmt.Sprintf("%d", cfg.RETENTION_DAYS))
+	}
+	if os.Getenv("MAX_FAILURE_RATIO") == "" && cfg.MAX_FAILURE_RATIO != "" {
+		os.Setenv("MAX_FAILURE_RATIO", cfg.MAX_FAILURE_RATIO)
+	}
+	if os.Getenv("FAILURE_MIN_SAMPLE") == "" && cfg.FAILURE_MIN_SAMPLE > 0 {
+		os.Setenv("FAILURE_MIN_SAMPLE", fmt.Sprintf("%d", cfg.FAILURE_MIN_SAMPLE))
+	}
+	if os.Getenv("FAILURE_WINDOW_MIN") == "" && cfg.FAILURE_WINDOW_MIN > 0 {
+		os.Setenv("FAILURE_WINDOW_MIN", fmt.Sprintf("%d", cfg.FAILURE_WINDOW_MIN))
+	}
+	if os.Getenv("REJECT_LOG") == "" && cfg.REJECT_LOG != "" {
+		os.Setenv("REJECT_LOG", cfg.REJECT_LOG)
+	}
+	if os.Getenv("AUTH_FAIL_MAX_PER_IP") == "" && cfg.AUTH_FAIL_MAX_PER_IP > 0 {
+		os.Setenv("AUTH_FAIL_MAX_PER_IP", fmt.Sprintf("%d", cfg.AUTH_FAIL_MAX_PER_IP))
+	}
+	if os.Getenv("AUTH_FAIL_MAX_PER_MAILBOX") == "" && cfg.AUTH_FAIL_MAX_PER_MAILBOX > 0 {
+		os.Setenv("AUTH_FAIL_MAX_PER_MAILBOX", fmt.Sprintf("%d", cfg.AUTH_FAIL_MAX_PER_MAILBOX))
+	}
+	if os.Getenv("AUTH_FAIL_WINDOW_MIN") == "" && cfg.AUTH_FAIL_WINDOW_MIN > 0 {
+		os.Setenv("AUTH_FAIL_WINDOW_MIN", fmt.Sprintf("%d", cfg.AUTH_FAIL_WINDOW_MIN))
+	}
+	if os.Getenv("AUTH_BLOCK_CMD") == "" && cfg.AUTH_BLOCK_CMD != "" {
+		os.Setenv("AUTH_BLOCK_CMD", cfg.AUTH_BLOCK_CMD)
+	}
+	if os.Getenv("ACTION_WORKERS") == "" && cfg.ACTION_WORKERS > 0 {
+		os.Setenv("ACTION_WORKERS", fmt.Sprintf("%d", cfg.ACTION_WORKERS))
+	}
+	if os.Getenv("ACTION_QUEUE") == "" && cfg.ACTION_QUEUE > 0 {
+		os.Setenv("ACTION_QUEUE", fmt.Sprintf("%d", cfg.ACTION_QUEUE))
+	}
 	if os.Getenv("TELEGRAM_BOT_TOKEN") == "" && cfg.TELEGRAM_BOT_TOKEN != "" {
 		os.Setenv("TELEGRAM_BOT_TOKEN", cfg.TELEGRAM_BOT_TOKEN)
 	}
@@ -150,18 +296,114 @@ func mergeEnvToConfig(cfg *AppConfig) *AppConfig {
 	if v := os.Getenv("EXIM_LOG"); v != "" {
 		cfg.EXIM_LOG = v
 	}
+	if v := os.Getenv("LOG_SOURCE"); v != "" {
+		cfg.LOG_SOURCE = v
+	}
+	if v := os.Getenv("JOURNAL_MATCH"); v != "" {
+		cfg.JOURNAL_MATCH = v
+	}
+	if v := os.Getenv("JOURNAL_FILE"); v != "" {
+		cfg.JOURNAL_FILE = v
+	}
+	if v := os.Getenv("LOG_TIMEZONE"); v != "" {
+		cfg.LOG_TIMEZONE = v
+	}
 	if v := os.Getenv("WHM_API_HOST"); v != "" {
 		cfg.WHM_API_HOST = v
 	}
 	if v := os.Getenv("PREFER_MODERN_UAPI"); v != "" {
 		cfg.PREFER_MODERN_UAPI = v
 	}
+	if v := os.Getenv("FOLLOW_MODE"); v != "" {
+		cfg.FOLLOW_MODE = v
+	}
+	if v := os.Getenv("CONTAIN_SCRIPTS"); v != "" {
+		cfg.CONTAIN_SCRIPTS = v
+	}
 	if v := os.Getenv("MAX_PER_MIN"); v != "" {
 		fmt.Sscanf(v, "%d", &cfg.MAX_PER_MIN)
 	}
 	if v := os.Getenv("MAX_PER_HOUR"); v != "" {
 		fmt.Sscanf(v, "%d", &cfg.MAX_PER_HOUR)
 	}
+	if v := os.Getenv("MAX_RCPT_PER_MIN"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MAX_RCPT_PER_MIN)
+	}
+	if v := os.Getenv("MAX_RCPT_PER_HOUR"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MAX_RCPT_PER_HOUR)
+	}
+	if v := os.Getenv("MIN_WINDOW_SEC"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MIN_WINDOW_SEC)
+	}
+	if v := os.Getenv("HOUR_WINDOW_MIN"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.HOUR_WINDOW_MIN)
+	}
+	if v := os.Getenv("MAX_PER_DAY"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MAX_PER_DAY)
+	}
+	if v := os.Getenv("MAX_PER_WEEK"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MAX_PER_WEEK)
+	}
+	if v := os.Getenv("MAX_PER_MONTH"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MAX_PER_MONTH)
+	}
+	if v := os.Getenv("ACCOUNT_MAX_PER_MIN"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.ACCOUNT_MAX_PER_MIN)
+	}
+	if v := os.Getenv("ACCOUNT_MAX_PER_HOUR"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.ACCOUNT_MAX_PER_HOUR)
+	}
+	if v := os.Getenv("ACCOUNT_MAX_PER_DAY"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.ACCOUNT_MAX_PER_DAY)
+	}
+	if v := os.Getenv("DOMAIN_MAX_PER_MIN"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.DOMAIN_MAX_PER_MIN)
+	}
+	if v := os.Getenv("DOMAIN_MAX_PER_HOUR"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.DOMAIN_MAX_PER_HOUR)
+	}
+	if v := os.Getenv("DOMAIN_MAX_PER_DAY"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.DOMAIN_MAX_PER_DAY)
+	}
+	if v := os.Getenv("MINUTE_RETENTION_DAYS"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.MINUTE_RETENTION_DAYS)
+	}
+	if v := os.Getenv("HOUR_RETENTION_DAYS"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.HOUR_RETENTION_DAYS)
+	}
+	if v := os.Getenv("RETENTION_DAYS"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.RETENTION_DAYS)
+	}
+	if v := os.Getenv("MAX_FAILURE_RATIO"); v != "" {
+		cfg.MAX_FAILURE_RATIO = v
+	}
+	if v := os.Getenv("FAILURE_MIN_SAMPLE"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.FAILURE_MIN_SAMPLE)
+	}
+	if v := os.Getenv("FAILURE_WINDOW_MIN"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.FAILURE_WINDOW_MIN)
+	}
+	if v := os.Getenv("REJECT_LOG"); v != "" {
+		cfg.REJECT_LOG = v
+	}
+	if v := os.Getenv("AUTH_FAIL_MAX_PER_IP"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.AUTH_FAIL_MAX_PER_IP)
+	}
+	if v := os.Getenv("AUTH_FAIL_MAX_PER_MAILBOX"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.AUTH_FAIL_MAX_PER_MAILBOX)
+	}
+	if v := os.Getenv("AUTH_FAIL_WINDOW_MIN"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.AUTH_FAIL_WINDOW_MIN)
+	}
+	if v := os.Getenv("AUTH_BLOCK_CMD"); v != "" {
+		cfg.AUTH_BLOCK_CMD = v
+	}
+	if v := os.Getenv("ACTION_WORKERS"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.ACTION_WORKERS)
+	}
+	if v := os.Getenv("ACTION_QUEUE"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.ACTION_QUEUE)
+	}
 	if v := os.Getenv("TELEGRAM_BOT_TOKEN"); v != "" {
 		cfg.TELEGRAM_BOT_TOKEN = v
 	}
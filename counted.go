@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+)
+
+// countedBucket holds the ids of the messages already counted, a bucket per
+// date. Sender keys are an address, user: or script:, never this name.
+const countedBucket = "counted-messages"
+
+// countOnce marks key, a message id or a message id and recipient, counted on
+// the date of thetime. It reports false when it was counted before, so
+// reading a part of a log again never changes the counts.
+func countOnce(thetime time.Time, key string) (bool, error) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	id := counterID{countedBucket, thetime.Format("2006-01-02"), key}
+	counted, err := counterValue(id)
+	if err != nil || counted > 0 {
+		return false, err
+	}
+	if err := logCounter(id, 1); err != nil {
+		return false, err
+	}
+	counterValues[id] = 1
+	counterPending[id] = true
+	return true, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// countersLogPath is the write-ahead log of the counters since the last
+// snapshot into countersPath. Counts are committed together with the cursor
+// of the log they were read from, a restart only replays committed counts and
+// reads the rest of the log again.
+var countersLogPath = "counters.wal"
+
+// the committed counters are saved to countersPath when the log is this old or large
+var (
+	snapshotInterval       = time.Minute
+	snapshotSize     int64 = 4 << 20
+)
+
+// counterRecord is a line of the log, a counter value, a commit or an abort
+type counterRecord struct {
+	Owner  string     `json:"o,omitempty"`
+	Date   string     `json:"d,omitempty"`
+	Key    string     `json:"k,omitempty"`
+	Value  int64      `json:"v,omitempty"`
+	Commit bool       `json:"commit,omitempty"`
+	Abort  bool       `json:"abort,omitempty"` // drops the values since the last commit
+	Path   string     `json:"path,omitempty"`  // cursor file of a commit
+	Cursor *logCursor `json:"cursor,omitempty"`
+}
+
+var (
+	counterLog       *os.File
+	counterLogWriter *bufio.Writer
+	counterLogSize   int64
+	lastSnapshot     time.Time
+	committedCursors = map[string]logCursor{}
+)
+
+// appendCounterRecord adds a record to the log, countersMu must be held
+func appendCounterRecord(r counterRecord) error {
+	if counterLog == nil {
+		return fmt.Errorf("%s is not open, only scanning counts", countersLogPath)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	n, err := counterLogWriter.Write(append(data, '\n'))
+	counterLogSize += int64(n)
+	return err
+}
+
+// logCounter adds a counter value to the log, countersMu must be held
+func logCounter(id counterID, count int64) error {
+	return appendCounterRecord(counterRecord{Owner: id.owner, Date: id.date, Key: id.key, Value: count})
+}
+
+// commitCounters makes the counts so far durable together with cursor and
+// then stores cursor at cursorPath. An empty cursorPath or cursor, as of
+// stdin or a saved journal, commits without a cursor and keeps the stored one.
+func commitCounters(cursorPath string, cursor logCursor) error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	if cursor == (logCursor{}) {
+		cursorPath = ""
+	}
+
+	if last, ok := committedCursors[cursorPath]; (cursorPath == "" || ok && last == cursor) && len(counterPending) == 0 {
+		return nil
+	}
+
+	record := counterRecord{Commit: true}
+	if cursorPath != "" {
+		record.Path = cursorPath
+		record.Cursor = &cursor
+	}
+	if err := appendCounterRecord(record); err != nil {
+		return err
+	}
+	if err := counterLogWriter.Flush(); err != nil {
+		return err
+	}
+	if err := counterLog.Sync(); err != nil {
+		return err
+	}
+
+	for id := range counterPending {
+		counterUnsaved[id] = counterValues[id]
+	}
+	counterPending = map[counterID]bool{}
+	rates.commit()
+
+	if cursorPath != "" {
+		committedCursors[cursorPath] = cursor
+		if err := storeCursor(cursorPath, cursor); err != nil {
+			log("Unable to store position: %+v", err)
+		}
+	}
+
+	if counterLogSize >= snapshotSize || time.Since(lastSnapshot) >= snapshotInterval {
+		debugLog("Saving %d counters to %s", len(counterUnsaved), countersPath)
+		return batchCounters(func(tx *bolt.Tx) error { return nil })
+	}
+	return nil
+}
+
+// rollbackCounters drops the counts and rate window messages since the last
+// commit, after a failed scan that reads its lines again from the stored cursor
+func rollbackCounters() error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	rates.rollback()
+	if len(counterPending) == 0 {
+		return nil
+	}
+	log("Dropping %d uncommitted counters", len(counterPending))
+	for id := range counterPending {
+		delete(counterValues, id)
+	}
+	counterPending = map[counterID]bool{}
+
+	if err := appendCounterRecord(counterRecord{Abort: true}); err != nil {
+		return err
+	}
+	return counterLogWriter.Flush()
+}
+
+// counterSaved empties the log once the committed counters are in the
+// database, keeping the ones still to be committed. countersMu must be held.
+func counterSaved() error {
+	counterUnsaved = map[counterID]int64{}
+	for id := range counterValues {
+		if !counterPending[id] {
+			delete(counterValues, id)
+		}
+	}
+	lastSnapshot = time.Now()
+
+	if counterLog == nil {
+		return nil
+	}
+	counterLogWriter.Reset(counterLog)
+	if err := counterLog.Truncate(0); err != nil {
+		return err
+	}
+	counterLogSize = 0
+	for id := range counterPending {
+		if err := logCounter(id, counterValues[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCounterLog returns the committed counters of the log and the last
+// committed cursor of each cursor file
+func readCounterLog() (map[counterID]int64, map[string]logCursor, error) {
+	committed := map[counterID]int64{}
+	cursors := map[string]logCursor{}
+
+	file, err := os.Open(countersLogPath)
+	if os.IsNotExist(err) {
+		return committed, cursors, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	pending := map[counterID]int64{}
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				debugLog("Ignoring the incomplete last record of %s", countersLogPath)
+			}
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		var r counterRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			log("Ignoring %s after an unreadable record: %v", countersLogPath, err)
+			break
+		}
+		switch {
+		case r.Commit:
+			for id, count := range pending {
+				committed[id] = count
+			}
+			pending = map[counterID]int64{}
+			if r.Cursor != nil {
+				cursors[r.Path] = *r.Cursor
+			}
+		case r.Abort:
+			pending = map[counterID]int64{}
+		default:
+			pending[counterID{r.Owner, r.Date, r.Key}] = r.Value
+		}
+	}
+
+	if len(pending) > 0 {
+		log("Dropping %d uncommitted counters of %s, their lines are read again", len(pending), countersLogPath)
+	}
+	return committed, cursors, nil
+}
+
+// recoverCounters replays the committed counters of the log into the
+// database and restores the cursors committed with them, before scanning
+func recoverCounters() error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	committed, cursors, err := readCounterLog()
+	if err != nil {
+		return err
+	}
+	for path, cursor := range cursors {
+		if err := storeCursor(path, cursor); err != nil {
+			return err
+		}
+		committedCursors[path] = cursor
+	}
+	if len(committed) > 0 {
+		log("Recovered %d counters from %s", len(committed), countersLogPath)
+	}
+	counterUnsaved = committed
+
+	file, err := os.OpenFile(countersLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	counterLog = file
+	counterLogWriter = bufio.NewWriterSize(file, 64*1024)
+	return batchCounters(func(tx *bolt.Tx) error { return nil })
+}
+
+// loadCounterLog reads the committed counters of a running scanner that are
+// not in the database yet, for commands that only read counters
+func loadCounterLog() error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	committed, _, err := readCounterLog()
+	if err != nil {
+		return err
+	}
+	counterUnsaved = committed
+	return nil
+}
+
+// closeCounters saves the committed counters and closes the log and the database
+func closeCounters() error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	if err := batchCounters(func(tx *bolt.Tx) error { return nil }); err != nil {
+		return err
+	}
+	if counterLog != nil {
+		if err := counterLog.Close(); err != nil {
+			return err
+		}
+		counterLog = nil
+	}
+	return closeCountersDB()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// tempCounters points the counter database and its log to a temporary
+// directory with nothing counted yet
+func tempCounters(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	oldPath, oldLogPath := countersPath, countersLogPath
+	countersPath = filepath.Join(dir, "counters.db")
+	countersLogPath = filepath.Join(dir, "counters.wal")
+	counterValues = map[counterID]int64{}
+	counterPending = map[counterID]bool{}
+	counterUnsaved = map[counterID]int64{}
+	committedCursors = map[string]logCursor{}
+
+	t.Cleanup(func() {
+		if err := closeCounters(); err != nil {
+			t.Errorf("closeCounters: %v", err)
+		}
+		countersPath, countersLogPath = oldPath, oldLogPath
+	})
+	return dir
+}
+
+// savedCounter reads a counter from the database, without the log
+func savedCounter(t *testing.T, id counterID) int64 {
+	t.Helper()
+	db, err := counters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := int64(0)
+	err = db.View(func(tx *bolt.Tx) error {
+		count, err = counterGet(tx, id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRecoverCounters(t *testing.T) {
+	dir := tempCounters(t)
+	cursorPath := filepath.Join(dir, ".config")
+	if err := storeCursor(cursorPath, logCursor{Path: "exim_mainlog", Offset: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := counterID{"a@example.com", "2024-03-05", "10"}
+	uncommitted := counterID{"b@example.com", "2024-03-05", "10"}
+	aborted := counterID{"c@example.com", "2024-03-05", "10"}
+	wal := `{"o":"a@example.com","d":"2024-03-05","k":"10","v":5}
+{"commit":true,"path":"` + cursorPath + `","cursor":{"path":"exim_mainlog","device":0,"inode":0,"offset":100,"line_start":90,"line":2,"prefix":""}}
+{"o":"c@example.com","d":"2024-03-05","k":"10","v":3}
+{"abort":true}
+{"o":"b@example.com","d":"2024-03-05","k":"10","v":7}
+{"o":"a@example.com","d":"2024-03-05","k":"10","v":9}
+{"commit":tr`
+	if err := os.WriteFile(countersLogPath, []byte(wal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverCounters(); err != nil {
+		t.Fatalf("recoverCounters: %v", err)
+	}
+
+	for id, want := range map[counterID]int64{committed: 5, uncommitted: 0, aborted: 0} {
+		if got := savedCounter(t, id); got != want {
+			t.Errorf("%v = %d, want %d", id, got, want)
+		}
+	}
+
+	cursor, err := loadCursor(cursorPath, "exim_mainlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Offset != 100 || cursor.Line != 2 {
+		t.Errorf("cursor = %+v, want the committed offset 100", cursor)
+	}
+
+	if fi, err := os.Stat(countersLogPath); err != nil || fi.Size() != 0 {
+		t.Errorf("log not emptied after the replay: %v %v", fi, err)
+	}
+}
+
+func TestRollbackCounters(t *testing.T) {
+	dir := tempCounters(t)
+	if err := recoverCounters(); err != nil {
+		t.Fatal(err)
+	}
+	cursorPath := filepath.Join(dir, ".config")
+	at := time.Date(2024, 3, 5, 10, 20, 0, 0, time.UTC)
+
+	if err := counterStore(at, "a@example.com", "", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitCounters(cursorPath, logCursor{Path: "exim_mainlog", Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := counterStore(at, "a@example.com", "", 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := rollbackCounters(); err != nil {
+		t.Fatal(err)
+	}
+
+	min, hour, err := counterRead(at, "a@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if min != 1 || hour != 1 {
+		t.Errorf("after rollback min=%d hour=%d, want the committed 1 1", min, hour)
+	}
+
+	// a crash now replays the commit, not the rolled back counts
+	committed, cursors, err := readCounterLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourID, minID := counterNames(at, "a@example.com", "")
+	if committed[hourID] != 1 || committed[minID] != 1 || len(committed) != 2 {
+		t.Errorf("committed = %v", committed)
+	}
+	if cursors[cursorPath].Offset != 10 {
+		t.Errorf("cursors = %v", cursors)
+	}
+}
+
+func TestCommitWithoutCursor(t *testing.T) {
+	dir := tempCounters(t)
+	if err := recoverCounters(); err != nil {
+		t.Fatal(err)
+	}
+	cursorPath := filepath.Join(dir, ".config")
+	stored := logCursor{Path: "exim_mainlog", Offset: 10, Line: 1, Prefix: "2024-03-05 10:20:00"}
+	if err := storeCursor(cursorPath, stored); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 5, 10, 20, 0, 0, time.UTC)
+
+	// stdin and saved journals have no position
+	if err := counterStore(at, "a@example.com", "", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitCounters(cursorPath, logCursor{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := loadCursor(cursorPath, "exim_mainlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != stored {
+		t.Errorf("cursor = %+v, want the stored %+v", cursor, stored)
+	}
+
+	committed, cursors, err := readCounterLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(committed) != 2 || len(cursors) != 0 {
+		t.Errorf("committed = %v, cursors = %v", committed, cursors)
+	}
+}
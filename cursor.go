@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"eximmon/tools"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// logCursor is the last scanned position, identified by device and inode so
+// it still finds the right file after logrotate renames it, or by the
+// journal cursor when reading from journald
+type logCursor struct {
+	Path      string `json:"path"`
+	Device    uint64 `json:"device"`
+	Inode     uint64 `json:"inode"`
+	Offset    int64  `json:"offset"`
+	LineStart int64  `json:"line_start"`
+	Line      int64  `json:"line"`
+	Prefix    string `json:"prefix"`
+	Journal   string `json:"journal,omitempty"`
+}
+
+func storeCursor(path string, cursor logCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	return tools.WriteFileAtomic(path, data, 0644)
+}
+
+// loadCursor reads the stored cursor, converting the older size||line||prefix format
+func loadCursor(path string, logFile string) (logCursor, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return logCursor{}, nil
+	} else if err != nil {
+		return logCursor{}, err
+	}
+
+	if !strings.HasPrefix(string(content), "{") {
+		return legacyCursor(path, string(content), logFile)
+	}
+
+	var cursor logCursor
+	if err := json.Unmarshal(content, &cursor); err != nil {
+		return logCursor{}, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	return cursor, nil
+}
+
+// legacyCursor walks logFile to the stored line number to find its byte offset
+func legacyCursor(path string, content string, logFile string) (logCursor, error) {
+	args := strings.Split(content, "||")
+	if len(args) < 3 {
+		return logCursor{}, fmt.Errorf("unknown cursor format in %s", path)
+	}
+	line, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return logCursor{}, err
+	}
+	prefix := strings.TrimRight(args[2], "\n")
+
+	log("Converting cursor at line %d of %s", line, logFile)
+	follower, err := openLogFollower(logFile)
+	if err != nil {
+		return logCursor{}, err
+	}
+	defer follower.Close()
+
+	text := ""
+	for follower.lineNo < line {
+		text, err = follower.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return logCursor{}, err
+		}
+	}
+
+	if follower.lineNo < line || !strings.HasPrefix(text, prefix) {
+		log("Last missing line:\n%s\nExpecting:\n%s\n", text, prefix)
+		return logCursor{}, nil //reset
+	}
+
+	return follower.Cursor(linePrefix(text)), nil
+}
+
+// findRotatedLog looks next to logFile for the renamed file the cursor points to,
+// e.g. exim_mainlog.1 or exim_mainlog-20240101
+func findRotatedLog(logFile string, cursor logCursor) (string, error) {
+	dir := filepath.Dir(logFile)
+	base := filepath.Base(logFile)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == base || !strings.HasPrefix(name, base) || !entry.Type().IsRegular() {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if device, inode := fileIdentity(fi); device == cursor.Device && inode == cursor.Inode {
+			return filepath.Join(dir, name), nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"eximmon/exim"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// domainKey is the name the totals of a sending domain are stored under
+func domainKey(domain string) string {
+	return "domain:" + strings.ToLower(domain)
+}
+
+// loadDomainLimits reads the allowances of single domains from the config file
+func loadDomainLimits(cfg *AppConfig) map[string]DomainLimit {
+	limits := map[string]DomainLimit{}
+	if cfg == nil {
+		return limits
+	}
+	for domain, limit := range cfg.DOMAIN_LIMITS {
+		limits[strings.ToLower(domain)] = limit
+	}
+	return limits
+}
+
+// countDomain adds a message of sender to the totals of its domain. While
+// the domain is over its limits every sender of it is suspended as it sends.
+func countDomain(sender senderIdentity, domain string, thetime time.Time, recipients int64, limits scanLimits) error {
+	if domain == "" {
+		return nil
+	}
+	key := domainKey(domain)
+
+	if _, _, err := counterAdd(thetime, key, "", 1); err != nil {
+		return err
+	}
+	if _, _, err := counterAdd(thetime, key, ".rcpt", recipients); err != nil {
+		return err
+	}
+
+	rates.add(key, thetime, recipients, limits.HourWindow)
+	lastMin := rates.count(key, thetime, limits.MinWindow)
+	lastHour := rates.count(key, thetime, limits.HourWindow)
+
+	limit := limits.domainLimit(domain)
+	day := int64(0)
+	if limit.MaxPerDay > 0 {
+		date := time.Date(thetime.Year(), thetime.Month(), thetime.Day(), 0, 0, 0, 0, thetime.Location())
+		var err error
+		if day, err = counterSum(date, thetime, key, ""); err != nil {
+			return err
+		}
+	}
+
+	if !over(lastMin.Messages, limit.MaxPerMin) && !over(lastHour.Messages, limit.MaxPerHour) && !over(day, limit.MaxPerDay) {
+		return nil
+	}
+
+	message := fmt.Sprintf("Domain %s: last %s: %d, last %s: %d, today: %d\nRecipients: last %s: %d, last %s: %d",
+		domain, limits.MinWindow, lastMin.Messages, limits.HourWindow, lastHour.Messages, day,
+		limits.MinWindow, lastMin.Recipients, limits.HourWindow, lastHour.Recipients)
+	suspendSender(sender, message)
+	return nil
+}
+
+// statsSuffixes are the counters of a stats row: sent, rcpt, delivered, deferred, failed
+var statsSuffixes = []string{"", ".rcpt", suffixDelivered, suffixDeferred, suffixFailed}
+
+// dayTotals returns the statsSuffixes counts of key on the date of day,
+// including the daily rollup of a pruned date
+func dayTotals(key string, day time.Time) ([]int64, error) {
+	totals := make([]int64, len(statsSuffixes))
+	for i, suffix := range statsSuffixes {
+		count, err := counterSum(day, day, key, suffix)
+		if err != nil {
+			return nil, err
+		}
+		totals[i] = count
+	}
+	return totals, nil
+}
+
+// mailboxTotals are the dayTotals of a mailbox of a domain
+type mailboxTotals struct {
+	Email  string
+	Totals []int64
+}
+
+// domainStats returns the totals of domain on the date of day and those of
+// each of its mailboxes that sent, most messages first
+func domainStats(domain string, day time.Time) ([]int64, []mailboxTotals, error) {
+	totals, err := dayTotals(domainKey(domain), day)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owners, err := counterOwners(day, "@"+domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	mailboxes := []mailboxTotals{}
+	for _, email := range owners {
+		counts, err := dayTotals(email, day)
+		if err != nil {
+			return nil, nil, err
+		}
+		if counts[0] > 0 || counts[2] > 0 || counts[3] > 0 || counts[4] > 0 {
+			mailboxes = append(mailboxes, mailboxTotals{email, counts})
+		}
+	}
+	sort.Slice(mailboxes, func(i, j int) bool {
+		if mailboxes[i].Totals[0] != mailboxes[j].Totals[0] {
+			return mailboxes[i].Totals[0] > mailboxes[j].Totals[0]
+		}
+		return mailboxes[i].Email < mailboxes[j].Email
+	})
+	return totals, mailboxes, nil
+}
+
+// isDomainName tells a domain given to stats from a mailbox or cPanel user,
+// cPanel usernames have no dots
+func isDomainName(name string) bool {
+	return strings.Contains(name, ".") && !strings.Contains(name, "@") && !strings.Contains(name, ":")
+}
+
+// printDomainStats shows the totals of a domain on a day and its mailboxes
+func printDomainStats(domain string, day time.Time, limits scanLimits) error {
+	totals, mailboxes, err := domainStats(domain, day)
+	if err != nil {
+		return err
+	}
+
+	log("%s on %s", domain, day.Format("2006-01-02"))
+	log("%-30s %8s %8s %10s %9s %7s", "mailbox", "sent", "rcpt", "delivered", "deferred", "failed")
+	for _, m := range mailboxes {
+		log("%-30s %8d %8d %10d %9d %7d", m.Email, m.Totals[0], m.Totals[1], m.Totals[2], m.Totals[3], m.Totals[4])
+	}
+	log("%-30s %8d %8d %10d %9d %7d", "total", totals[0], totals[1], totals[2], totals[3], totals[4])
+
+	limit := limits.domainLimit(domain)
+	if limit.MaxPerDay > 0 {
+		log("limit: day %d/%d", totals[0], limit.MaxPerDay)
+	}
+	return nil
+}
+
+// statsReport answers /stats of the bots with today's counts of a domain
+// broken down by mailbox, or of a sender or account:user
+func statsReport(name string, limits scanLimits) (string, error) {
+	day := time.Now().In(exim.Location)
+	row := func(counts []int64) string {
+		return fmt.Sprintf("%d sent, %d rcpt, %d delivered, %d deferred, %d failed", counts[0], counts[1], counts[2], counts[3], counts[4])
+	}
+
+	var sb strings.Builder
+	if isDomainName(name) {
+		totals, mailboxes, err := domainStats(name, day)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf("📊 *Stats for* `%s` *on %s*\n\n", name, day.Format("2006-01-02")))
+		sb.WriteString("Total: " + row(totals) + "\n")
+		if limit := limits.domainLimit(name); limit.MaxPerDay > 0 {
+			sb.WriteString(fmt.Sprintf("Limit: day %d/%d\n", totals[0], limit.MaxPerDay))
+		}
+		if len(mailboxes) > 0 {
+			sb.WriteString("\n")
+		}
+		for _, m := range mailboxes {
+			sb.WriteString(fmt.Sprintf("• `%s` - %s\n", m.Email, row(m.Totals)))
+		}
+		return sb.String(), nil
+	}
+
+	key := parseCounterKey(name)
+	totals, err := dayTotals(key, day)
+	if err != nil {
+		return "", err
+	}
+	sb.WriteString(fmt.Sprintf("📊 *Stats for* `%s` *on %s*\n\n", key, day.Format("2006-01-02")))
+	sb.WriteString("Total: " + row(totals) + "\n")
+	if quotasEnabled(limits) && !strings.HasPrefix(key, "account:") {
+		quota, err := quotaCount(day, key)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("Quota: " + quota.format(limits) + "\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,236 @@
+package exim
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags that follow the message id on a mainlog line
+const (
+	FlagArrival   = "<="
+	FlagDelivery  = "=>"
+	FlagCopy      = "->"
+	FlagCutthru   = ">>"
+	FlagFailed    = "**"
+	FlagDeferred  = "=="
+	FlagSuppress  = "*>"
+	FlagCompleted = "Completed"
+)
+
+// messageIDReg matches both the classic (1rAbCd-000123-AB) and the
+// exim 4.97+ (1rAbCd-00000001234-ABCD) message id formats
+var messageIDReg = regexp.MustCompile("^[0-9A-Za-z]{6}-[0-9A-Za-z]{6,11}-[0-9A-Za-z]{2,4}$")
+
+// fieldReg matches the start of a tagged field, e.g. H= or id=
+var fieldReg = regexp.MustCompile("^([A-Za-z][A-Za-z0-9]*)=")
+
+// phpScriptReg matches the headers PHP adds to mail(), when they are logged
+var phpScriptReg = regexp.MustCompile("(?i)X-PHP-(Originating-)?Script: ?\"?([^ \"]+)")
+
+// LogEntry is a parsed exim mainlog line
+type LogEntry struct {
+	Time      time.Time
+	PID       string // with log_selector +pid
+	MessageID string
+	Flag      string // <=, =>, ->, **, ==, Completed, ... or empty
+	Address   string // sender on arrivals, recipient on deliveries
+
+	Host      string // H=
+	User      string // U=
+	Protocol  string // P=
+	Size      int64  // S=
+	Auth      string // A=, e.g. dovecot_login:user@example.com
+	Subject   string // T= on arrivals
+	Transport string // T= on deliveries
+	Router    string // R=
+	From      string // F=
+	HeaderID  string // id=
+
+	Recipients []string          // addresses after "for" on arrivals
+	Error      string            // error text of ** and == lines
+	Fields     map[string]string // every tagged field as logged
+	Message    string            // text after the message id when there is no flag
+	Raw        string
+
+	Cwd               string // cwd= of a local submission, logged before its message id
+	Args              string // command line of that submission
+	PHPScript         string // X-PHP-Script: domain/path/script.php
+	OriginatingScript string // X-PHP-Originating-Script: uid:script.php
+}
+
+// ParseLine parses any mainlog line. Lines without a message id, like
+// connection logs, return an entry with only Time and Message set.
+func ParseLine(line string) (LogEntry, error) {
+	entry := LogEntry{Raw: line, Fields: map[string]string{}}
+
+	t, n, err := ParseTimestamp(line)
+	if err != nil {
+		return entry, err
+	}
+	entry.Time = t
+
+	tokens := splitTokens(line[n:])
+	// optional [pid] from log_selector +pid
+	if len(tokens) > 0 && strings.HasPrefix(tokens[0], "[") && strings.HasSuffix(tokens[0], "]") {
+		entry.PID = strings.Trim(tokens[0], "[]")
+		tokens = tokens[1:]
+	}
+
+	for _, m := range phpScriptReg.FindAllStringSubmatch(line, -1) {
+		if m[1] != "" {
+			entry.OriginatingScript = m[2]
+		} else {
+			entry.PHPScript = m[2]
+		}
+	}
+
+	if len(tokens) == 0 || !messageIDReg.MatchString(tokens[0]) {
+		entry.Message = strings.Join(tokens, " ")
+		if len(tokens) > 0 && strings.HasPrefix(tokens[0], "cwd=") {
+			// log_selector +arguments, e.g. cwd=/home/user/public_html 3 args: /usr/sbin/sendmail -t -i
+			entry.Cwd = strings.TrimPrefix(tokens[0], "cwd=")
+			if i := strings.Index(entry.Message, "args: "); i >= 0 {
+				entry.Args = entry.Message[i+len("args: "):]
+			}
+		}
+		return entry, nil
+	}
+	entry.MessageID = tokens[0]
+	tokens = tokens[1:]
+
+	if len(tokens) == 0 {
+		return entry, nil
+	}
+
+	switch tokens[0] {
+	case FlagArrival, FlagDelivery, FlagCopy, FlagCutthru, FlagFailed, FlagDeferred, FlagSuppress:
+		entry.Flag = tokens[0]
+		tokens = tokens[1:]
+	case FlagCompleted:
+		entry.Flag = FlagCompleted
+		return entry, nil
+	default:
+		entry.Message = strings.Join(tokens, " ")
+		return entry, nil
+	}
+
+	if len(tokens) > 0 && fieldReg.FindString(tokens[0]) == "" {
+		entry.Address = strings.Trim(tokens[0], "<>")
+		tokens = tokens[1:]
+	}
+
+	key := ""
+	for i, token := range tokens {
+		if entry.Flag == FlagArrival && token == "for" {
+			entry.Recipients = append(entry.Recipients, tokens[i+1:]...)
+			break
+		}
+
+		if (entry.Flag == FlagFailed || entry.Flag == FlagDeferred) && strings.HasSuffix(token, ":") {
+			// fields end at the first colon, the rest is the error
+			token = strings.TrimSuffix(token, ":")
+			entry.Error = strings.Join(tokens[i+1:], " ")
+			if token != "" {
+				if key != "" && fieldReg.FindString(token) == "" {
+					entry.Fields[key] += " " + token
+				} else if m := fieldReg.FindStringSubmatch(token); m != nil {
+					entry.Fields[m[1]] = token[len(m[0]):]
+				}
+			}
+			break
+		}
+
+		if m := fieldReg.FindStringSubmatch(token); m != nil {
+			key = m[1]
+			entry.Fields[key] = token[len(m[0]):]
+			continue
+		}
+
+		if key == "" {
+			// extra address details, e.g. <original@address> or (parent)
+			continue
+		}
+		entry.Fields[key] += " " + token
+	}
+
+	entry.applyFields()
+	return entry, nil
+}
+
+// applyFields copies the known tagged fields into their typed members
+func (e *LogEntry) applyFields() {
+	e.Host = e.Fields["H"]
+	e.User = e.Fields["U"]
+	e.Protocol = e.Fields["P"]
+	e.Auth = e.Fields["A"]
+	e.Router = e.Fields["R"]
+	e.From = strings.Trim(e.Fields["F"], "<>")
+	e.HeaderID = e.Fields["id"]
+
+	if s, ok := e.Fields["S"]; ok {
+		e.Size, _ = strconv.ParseInt(s, 10, 64)
+	}
+
+	if t, ok := e.Fields["T"]; ok {
+		if e.Flag == FlagArrival {
+			e.Subject = unquote(t)
+		} else {
+			e.Transport = t
+		}
+	}
+}
+
+// Authenticator returns the authenticator name of A=, e.g. dovecot_login
+func (e LogEntry) Authenticator() string {
+	if i := strings.Index(e.Auth, ":"); i >= 0 {
+		return e.Auth[:i]
+	}
+	return e.Auth
+}
+
+// AuthenticatedID returns the login of A=, e.g. user@example.com
+func (e LogEntry) AuthenticatedID() string {
+	if i := strings.Index(e.Auth, ":"); i >= 0 {
+		return e.Auth[i+1:]
+	}
+	return ""
+}
+
+// splitTokens splits on spaces, keeping double quoted values like T="a b" together
+func splitTokens(s string) []string {
+	tokens := []string{}
+	var sb strings.Builder
+	quoted := false
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if sb.Len() > 0 {
+				tokens = append(tokens, sb.String())
+				sb.Reset()
+			}
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() > 0 {
+		tokens = append(tokens, sb.String())
+	}
+	return tokens
+}
+
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return strings.Trim(s, "\"")
+}
@@ -0,0 +1,205 @@
+package exim
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	Location = time.UTC
+
+	tests := []struct {
+		name string
+		line string
+		want LogEntry
+	}{
+		{
+			name: "arrival",
+			line: `2024-03-05 10:20:30 1rAbCd-000123-AB <= user@example.com H=(client) [192.0.2.1]:51234 P=esmtpsa A=dovecot_login:user@example.com S=2048 id=abc@example.com T="Monthly report: \"final\"" for a@example.org b@example.net`,
+			want: LogEntry{
+				MessageID:  "1rAbCd-000123-AB",
+				Flag:       FlagArrival,
+				Address:    "user@example.com",
+				Host:       "(client) [192.0.2.1]:51234",
+				Protocol:   "esmtpsa",
+				Auth:       "dovecot_login:user@example.com",
+				Size:       2048,
+				HeaderID:   "abc@example.com",
+				Subject:    `Monthly report: "final"`,
+				Recipients: []string{"a@example.org", "b@example.net"},
+			},
+		},
+		{
+			name: "local arrival",
+			line: `2024-03-05 10:20:30 1rAbCd-00000001234-ABCD <= cpuser@server.example.com U=cpuser P=local S=512 T="hello world"`,
+			want: LogEntry{
+				MessageID: "1rAbCd-00000001234-ABCD",
+				Flag:      FlagArrival,
+				Address:   "cpuser@server.example.com",
+				User:      "cpuser",
+				Protocol:  "local",
+				Size:      512,
+				Subject:   "hello world",
+			},
+		},
+		{
+			name: "delivery",
+			line: `2024-03-05 10:20:31 1rAbCd-000123-AB => a@example.org R=dkim_lookuphost T=dkim_remote_smtp H=mx.example.org [198.51.100.2] C="250 OK"`,
+			want: LogEntry{
+				MessageID: "1rAbCd-000123-AB",
+				Flag:      FlagDelivery,
+				Address:   "a@example.org",
+				Router:    "dkim_lookuphost",
+				Transport: "dkim_remote_smtp",
+				Host:      "mx.example.org [198.51.100.2]",
+			},
+		},
+		{
+			name: "copy",
+			line: `2024-03-05 10:20:31 1rAbCd-000123-AB -> b@example.net <B@example.net> R=dkim_lookuphost T=dkim_remote_smtp H=mx.example.net [203.0.113.5]`,
+			want: LogEntry{
+				MessageID: "1rAbCd-000123-AB",
+				Flag:      FlagCopy,
+				Address:   "b@example.net",
+				Router:    "dkim_lookuphost",
+				Transport: "dkim_remote_smtp",
+				Host:      "mx.example.net [203.0.113.5]",
+			},
+		},
+		{
+			name: "failed",
+			line: `2024-03-05 10:20:32 1rAbCd-000123-AB ** nobody@example.org R=dkim_lookuphost T=dkim_remote_smtp H=mx.example.org [198.51.100.2]: SMTP error from remote mail server after RCPT TO:<nobody@example.org>: 550 5.1.1 User unknown`,
+			want: LogEntry{
+				MessageID: "1rAbCd-000123-AB",
+				Flag:      FlagFailed,
+				Address:   "nobody@example.org",
+				Router:    "dkim_lookuphost",
+				Transport: "dkim_remote_smtp",
+				Host:      "mx.example.org [198.51.100.2]",
+				Error:     "SMTP error from remote mail server after RCPT TO:<nobody@example.org>: 550 5.1.1 User unknown",
+			},
+		},
+		{
+			name: "deferred",
+			line: `2024-03-05 10:20:33 1rAbCd-000123-AB == a@example.org R=dkim_lookuphost T=dkim_remote_smtp defer (-44) H=mx.example.org [198.51.100.2]: SMTP error from remote mail server after RCPT TO:<a@example.org>: 451 4.7.1 Try again later`,
+			want: LogEntry{
+				MessageID: "1rAbCd-000123-AB",
+				Flag:      FlagDeferred,
+				Address:   "a@example.org",
+				Router:    "dkim_lookuphost",
+				Transport: "dkim_remote_smtp defer (-44)",
+				Host:      "mx.example.org [198.51.100.2]",
+				Error:     "SMTP error from remote mail server after RCPT TO:<a@example.org>: 451 4.7.1 Try again later",
+			},
+		},
+		{
+			name: "completed",
+			line: `2024-03-05 10:20:34 1rAbCd-000123-AB Completed`,
+			want: LogEntry{
+				MessageID: "1rAbCd-000123-AB",
+				Flag:      FlagCompleted,
+			},
+		},
+		{
+			name: "cwd",
+			line: `2024-03-05 10:20:29 cwd=/home/cpuser/public_html 3 args: /usr/sbin/sendmail -t -i`,
+			want: LogEntry{
+				Message: "cwd=/home/cpuser/public_html 3 args: /usr/sbin/sendmail -t -i",
+				Cwd:     "/home/cpuser/public_html",
+				Args:    "/usr/sbin/sendmail -t -i",
+			},
+		},
+		{
+			name: "pid",
+			line: `2024-03-05 10:20:30 [12345] 1rAbCd-000123-AB <= user@example.com H=localhost [127.0.0.1] P=esmtpa A=dovecot_plain:user@example.com S=100 T="a b c" for c@example.org`,
+			want: LogEntry{
+				PID:        "12345",
+				MessageID:  "1rAbCd-000123-AB",
+				Flag:       FlagArrival,
+				Address:    "user@example.com",
+				Host:       "localhost [127.0.0.1]",
+				Protocol:   "esmtpa",
+				Auth:       "dovecot_plain:user@example.com",
+				Size:       100,
+				Subject:    "a b c",
+				Recipients: []string{"c@example.org"},
+			},
+		},
+		{
+			name: "pid cwd",
+			line: `2024-03-05 10:20:29 [4242] cwd=/home/cpuser 2 args: /usr/sbin/sendmail -t`,
+			want: LogEntry{
+				PID:     "4242",
+				Message: "cwd=/home/cpuser 2 args: /usr/sbin/sendmail -t",
+				Cwd:     "/home/cpuser",
+				Args:    "/usr/sbin/sendmail -t",
+			},
+		},
+		{
+			name: "connection",
+			line: `2024-03-05 10:20:28 SMTP connection from [192.0.2.1]:51234 lost`,
+			want: LogEntry{
+				Message: "SMTP connection from [192.0.2.1]:51234 lost",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if err != nil {
+				t.Fatalf("ParseLine: %v", err)
+			}
+			if got.Raw != tt.line {
+				t.Errorf("Raw = %q", got.Raw)
+			}
+
+			got.Raw, got.Fields, got.Time = "", nil, time.Time{}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLine\n got  %+v\n want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLineTime(t *testing.T) {
+	Location = time.UTC
+
+	tests := []struct {
+		line string
+		want time.Time
+	}{
+		{"2024-03-05 10:20:30 1rAbCd-000123-AB Completed", time.Date(2024, 3, 5, 10, 20, 30, 0, time.UTC)},
+		{"2024-03-05 10:20:30.125 1rAbCd-000123-AB Completed", time.Date(2024, 3, 5, 10, 20, 30, 125e6, time.UTC)},
+		{"2024-03-05 10:20:30 +0200 1rAbCd-000123-AB Completed", time.Date(2024, 3, 5, 8, 20, 30, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLine(tt.line)
+		if err != nil {
+			t.Fatalf("ParseLine(%q): %v", tt.line, err)
+		}
+		if !got.Time.Equal(tt.want) {
+			t.Errorf("ParseLine(%q).Time = %v, want %v", tt.line, got.Time, tt.want)
+		}
+		if got.MessageID != "1rAbCd-000123-AB" || got.Flag != FlagCompleted {
+			t.Errorf("ParseLine(%q) = %q %q", tt.line, got.MessageID, got.Flag)
+		}
+	}
+
+	if _, err := ParseLine("2024-03-05"); err == nil {
+		t.Errorf("ParseLine of a short line did not fail")
+	}
+}
+
+func TestAuthenticatedID(t *testing.T) {
+	e := LogEntry{Auth: "dovecot_login:user@example.com"}
+	if e.Authenticator() != "dovecot_login" || e.AuthenticatedID() != "user@example.com" {
+		t.Errorf("got %q %q", e.Authenticator(), e.AuthenticatedID())
+	}
+	e = LogEntry{Auth: "fixed_plain"}
+	if e.Authenticator() != "fixed_plain" || e.AuthenticatedID() != "" {
+		t.Errorf("got %q %q", e.Authenticator(), e.AuthenticatedID())
+	}
+}
@@ -1,22 +1,68 @@
 package exim
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
+
+// Location is the timezone of log timestamps logged without log_timezone,
+// and of the dates used for counters
+var Location = time.Local
 
 // ParseDate get local time of a date
 func ParseDate(thedate string) (time.Time, error) {
-	local := time.Now()
-
 	if len(thedate) > 10 {
-		t, err := time.ParseInLocation("2006-01-02 15:04:05", thedate, local.Location())
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", thedate, Location)
 		if err != nil {
 			return time.Time{}, err
 		}
 		return t, nil
 	} else {
-		t, err := time.ParseInLocation("2006-01-02", thedate, local.Location())
+		t, err := time.ParseInLocation("2006-01-02", thedate, Location)
 		if err != nil {
 			return time.Time{}, err
 		}
 		return t, nil
 	}
 }
+
+// ParseTimestamp reads the timestamp a log line starts with and returns its
+// length. It handles the millisec log_selector (12:00:00.123) and the
+// log_timezone option (12:00:00 +0700), the time is returned in Location.
+func ParseTimestamp(line string) (time.Time, int, error) {
+	if len(line) < 19 {
+		return time.Time{}, 0, fmt.Errorf("line too short for a timestamp: %q", line)
+	}
+
+	n := 19
+	layout := "2006-01-02 15:04:05"
+	if len(line) >= 23 && line[19] == '.' && isDigits(line[20:23]) {
+		n = 23
+		layout += ".000"
+	}
+
+	if len(line) >= n+6 && line[n] == ' ' && (line[n+1] == '+' || line[n+1] == '-') && isDigits(line[n+2:n+6]) {
+		t, err := time.Parse(layout+" -0700", line[:n+6])
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		return t.In(Location), n + 6, nil
+	}
+
+	// without an offset the hour repeated when DST ends is ambiguous, only
+	// log_timezone tells the two apart
+	t, err := time.ParseInLocation(layout, line[:n], Location)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return t, n, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,106 @@
+package exim
+
+import "time"
+
+// Message is everything logged about one message id, from its arrival
+// until Completed
+type Message struct {
+	ID        string
+	Arrival   LogEntry
+	Delivered map[string]time.Time // recipient => delivery time, => and ->
+	Deferred  map[string]int       // recipient => number of deferrals
+	Failed    map[string]string    // recipient => error
+	Completed bool
+	LastSeen  time.Time
+}
+
+// Tracker correlates log lines sharing a message id. Only messages whose
+// arrival was seen are tracked.
+type Tracker struct {
+	MaxAge     time.Duration
+	messages   map[string]*Message
+	lastExpire time.Time
+}
+
+// NewTracker keeps messages until Completed, or maxAge after their last line
+func NewTracker(maxAge time.Duration) *Tracker {
+	return &Tracker{
+		MaxAge:   maxAge,
+		messages: make(map[string]*Message),
+	}
+}
+
+// Add records a line. It returns the message it belongs to, or nil when the
+// arrival of that message was never seen, and whether this line is the
+// first outcome logged for its recipient.
+func (t *Tracker) Add(entry LogEntry) (*Message, bool) {
+	if entry.MessageID == "" {
+		return nil, false
+	}
+
+	if entry.Time.Sub(t.lastExpire) > time.Minute {
+		t.Expire(entry.Time)
+		t.lastExpire = entry.Time
+	}
+
+	if entry.Flag == FlagArrival {
+		msg := &Message{
+			ID:        entry.MessageID,
+			Arrival:   entry,
+			Delivered: map[string]time.Time{},
+			Deferred:  map[string]int{},
+			Failed:    map[string]string{},
+			LastSeen:  entry.Time,
+		}
+		t.messages[entry.MessageID] = msg
+		return msg, true
+	}
+
+	msg, ok := t.messages[entry.MessageID]
+	if !ok {
+		return nil, false
+	}
+	msg.LastSeen = entry.Time
+
+	first := false
+	switch entry.Flag {
+	case FlagDelivery, FlagCopy, FlagCutthru:
+		_, seen := msg.Delivered[entry.Address]
+		first = !seen
+		msg.Delivered[entry.Address] = entry.Time
+	case FlagDeferred:
+		first = msg.Deferred[entry.Address] == 0
+		msg.Deferred[entry.Address]++
+	case FlagFailed:
+		_, seen := msg.Failed[entry.Address]
+		first = !seen
+		msg.Failed[entry.Address] = entry.Error
+	case FlagCompleted:
+		msg.Completed = true
+		delete(t.messages, entry.MessageID)
+	}
+
+	return msg, first
+}
+
+// Get returns a tracked message
+func (t *Tracker) Get(id string) *Message {
+	return t.messages[id]
+}
+
+// Len is the number of messages still waiting for Completed
+func (t *Tracker) Len() int {
+	return len(t.messages)
+}
+
+// Expire forgets messages with no line since MaxAge before now
+func (t *Tracker) Expire(now time.Time) []*Message {
+	expired := []*Message{}
+	for id, msg := range t.messages {
+		if now.Sub(msg.LastSeen) > t.MaxAge {
+			expired = append(expired, msg)
+			delete(t.messages, id)
+		}
+	}
+	return expired
+}
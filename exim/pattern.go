@@ -0,0 +1,90 @@
+package exim
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern is a user defined expression for lines the built-in parser
+// misreads with a custom log_selector. Its named groups fill the entry:
+// id, flag, address, recipients, cwd, login (the authenticated id of A=),
+// and tagged fields such as A, U, P, H or S.
+type Pattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+}
+
+// NewPattern compiles a named pattern, it needs at least one named group
+func NewPattern(name string, expr string) (Pattern, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return Pattern{}, fmt.Errorf("pattern %s: %v", name, err)
+	}
+
+	for _, group := range re.SubexpNames() {
+		if group != "" {
+			return Pattern{Name: name, Regexp: re}, nil
+		}
+	}
+	return Pattern{}, fmt.Errorf("pattern %s has no named groups, e.g. (?P<A>\\S+)", name)
+}
+
+// Apply fills entry from the named groups when its line matches
+func (p Pattern) Apply(entry *LogEntry) bool {
+	match := p.Regexp.FindStringSubmatch(entry.Raw)
+	if match == nil {
+		return false
+	}
+
+	login := ""
+	for i, name := range p.Regexp.SubexpNames() {
+		if name == "" || match[i] == "" {
+			continue
+		}
+		value := match[i]
+		switch name {
+		case "login":
+			login = value
+		case "id":
+			entry.MessageID = value
+		case "flag":
+			entry.Flag = value
+		case "address":
+			entry.Address = strings.Trim(value, "<>")
+		case "recipients":
+			entry.Recipients = strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+		case "cwd":
+			entry.Cwd = value
+		default:
+			entry.Fields[name] = value
+		}
+	}
+
+	if login != "" {
+		authenticator := strings.SplitN(entry.Fields["A"], ":", 2)[0]
+		if authenticator == "" {
+			authenticator = p.Name
+		}
+		entry.Fields["A"] = authenticator + ":" + login
+	}
+
+	entry.applyFields()
+	return true
+}
+
+// ParseLineWith parses line with the built-in parser, then with the first
+// matching pattern. It returns the name of that pattern, if any.
+func ParseLineWith(line string, patterns []Pattern) (LogEntry, string, error) {
+	entry, err := ParseLine(line)
+	if err != nil {
+		return entry, "", err
+	}
+
+	for _, p := range patterns {
+		if p.Apply(&entry) {
+			return entry, p.Name, nil
+		}
+	}
+	return entry, "", nil
+}
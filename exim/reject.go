@@ -0,0 +1,41 @@
+package exim
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// authFailureReg matches a failed SMTP login in exim_rejectlog, e.g.
+// dovecot_login authenticator failed for (User) [203.0.113.5]:51234: 535 Incorrect authentication data (set_id=info@example.com)
+var authFailureReg = regexp.MustCompile(`(\S+) authenticator failed for .*?\[([0-9A-Fa-f.:]+)\](?::\d+)?(?: \S+)*?: 535 Incorrect authentication data(?: \(set_id=([^)]*)\))?`)
+
+// AuthFailure is a rejected SMTP authentication attempt
+type AuthFailure struct {
+	Time          time.Time
+	Authenticator string // e.g. dovecot_login
+	IP            string
+	SetID         string // the login that was tried, empty when not logged
+	Raw           string
+}
+
+// ParseAuthFailure parses a reject log line, ok is false for any other rejection
+func ParseAuthFailure(line string) (AuthFailure, bool, error) {
+	match := authFailureReg.FindStringSubmatch(line)
+	if match == nil {
+		return AuthFailure{}, false, nil
+	}
+
+	t, _, err := ParseTimestamp(line)
+	if err != nil {
+		return AuthFailure{}, false, err
+	}
+
+	return AuthFailure{
+		Time:          t,
+		Authenticator: match[1],
+		IP:            match[2],
+		SetID:         strings.ToLower(match[3]),
+		Raw:           line,
+	}, true, nil
+}
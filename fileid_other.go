@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func fileIdentity(fi os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// followWait is the longest time a follower sleeps before re-checking the log,
+// even when no change notification arrives
+var followWait = 1 * time.Second
+
+// logFollower reads complete lines from an exim log and keeps the file open,
+// so new lines can be picked up as they are appended
+type logFollower struct {
+	path      string
+	file      *os.File
+	reader    *bufio.Reader
+	partial   string
+	lineNo    int64 // number of complete lines read
+	offset    int64 // bytes of complete lines read
+	lineStart int64 // offset of the last line returned
+	device    uint64
+	inode     uint64
+	watcher   fileWatcher
+}
+
+// fileWatcher blocks until the watched file changes or the timeout expires
+type fileWatcher interface {
+	Wait(timeout time.Duration)
+	Close() error
+}
+
+// pollWatcher is the fallback watcher, it simply sleeps
+type pollWatcher struct {
+	interval time.Duration
+}
+
+func (w *pollWatcher) Wait(timeout time.Duration) {
+	if w.interval < timeout {
+		timeout = w.interval
+	}
+	time.Sleep(timeout)
+}
+
+func (w *pollWatcher) Close() error {
+	return nil
+}
+
+func openLogFollower(path string) (*logFollower, error) {
+	f := &logFollower{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFollower) open() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if f.watcher != nil {
+		f.watcher.Close()
+		f.watcher = nil
+	}
+
+	f.file = file
+	f.reader = bufio.NewReaderSize(file, 64*1024)
+	f.partial = ""
+	f.lineNo = 0
+	f.offset = 0
+	f.lineStart = 0
+	f.device, f.inode = fileIdentity(fi)
+	return nil
+}
+
+func (f *logFollower) Close() error {
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
+	return f.file.Close()
+}
+
+// ReadLine returns the next complete line without its line ending, or io.EOF
+// when no complete line is available yet
+func (f *logFollower) ReadLine() (string, error) {
+	chunk, err := f.reader.ReadString('\n')
+	if err != nil {
+		// keep incomplete line until exim finishes writing it
+		f.partial += chunk
+		return "", err
+	}
+
+	line := f.partial + chunk
+	f.partial = ""
+	f.lineNo++
+	f.lineStart = f.offset
+	f.offset += int64(len(line))
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// SeekTo continues reading at offset, line is only used for reporting
+func (f *logFollower) SeekTo(offset int64, line int64) error {
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	f.reader.Reset(f.file)
+	f.partial = ""
+	f.offset = offset
+	f.lineStart = offset
+	f.lineNo = line
+	return nil
+}
+
+// Resume moves the follower to the position stored in cursor. It returns
+// false when the file no longer matches the cursor.
+func (f *logFollower) Resume(cursor logCursor) (bool, error) {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() < cursor.Offset {
+		log("Size shrinked: %d, expected: %d", fi.Size(), cursor.Offset)
+		return false, nil
+	}
+
+	if cursor.Prefix != "" {
+		buf := make([]byte, len(cursor.Prefix))
+		if _, err := f.file.ReadAt(buf, cursor.LineStart); err != nil || string(buf) != cursor.Prefix {
+			log("Last missing line:\n%s\nExpecting:\n%s\n", buf, cursor.Prefix)
+			return false, nil
+		}
+	}
+
+	if err := f.SeekTo(cursor.Offset, cursor.Line); err != nil {
+		return false, err
+	}
+	f.lineStart = cursor.LineStart
+	return true, nil
+}
+
+func (f *logFollower) LineNo() int64 {
+	return f.lineNo
+}
+
+// Cursor returns the position after the last line read, prefix identifies that line
+func (f *logFollower) Cursor(prefix string) logCursor {
+	return logCursor{
+		Path:      f.path,
+		Device:    f.device,
+		Inode:     f.inode,
+		Offset:    f.offset,
+		LineStart: f.lineStart,
+		Line:      f.lineNo,
+		Prefix:    prefix,
+	}
+}
+
+// Wait blocks until the log changes, up to followWait. It reopens the log when
+// it has been rotated or truncated, and reports whether that happened.
+func (f *logFollower) Wait() (bool, error) {
+	rotated, err := f.rotated()
+	if err != nil {
+		return false, err
+	}
+
+	if rotated {
+		// drain whatever was appended to the old file before moving on
+		if _, err := f.reader.Peek(1); err == nil {
+			return false, nil
+		}
+
+		log("Log rotated, reopening %s", f.path)
+		f.file.Close()
+		if err := f.open(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if f.watcher == nil {
+		f.watcher = newFileWatcher(f.path)
+	}
+	f.watcher.Wait(followWait)
+	return false, nil
+}
+
+// rotated checks whether the path now points to a different or shorter file
+func (f *logFollower) rotated() (bool, error) {
+	pathInfo, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		// rotation in progress, new file not created yet
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	fileInfo, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if !os.SameFile(pathInfo, fileInfo) {
+		return true, nil
+	}
+
+	pending := int64(len(f.partial))
+	return pathInfo.Size() < f.offset+pending, nil
+}
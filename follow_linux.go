@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyWatcher wakes up as soon as the kernel reports a change to the log
+type inotifyWatcher struct {
+	fd  int
+	buf []byte
+}
+
+func newFileWatcher(path string) fileWatcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		debugLog("inotify unavailable, polling %s: %v", path, err)
+		return &pollWatcher{interval: 500 * time.Millisecond}
+	}
+
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF)
+	if _, err := syscall.InotifyAddWatch(fd, path, mask); err != nil || fd >= syscall.FD_SETSIZE {
+		debugLog("inotify watch failed, polling %s: %v", path, err)
+		syscall.Close(fd)
+		return &pollWatcher{interval: 500 * time.Millisecond}
+	}
+
+	return &inotifyWatcher{fd: fd, buf: make([]byte, 4096)}
+}
+
+func (w *inotifyWatcher) Wait(timeout time.Duration) {
+	// FdSet words are 32 bits on 386 and arm, 64 bits elsewhere
+	var set syscall.FdSet
+	bits := int(unsafe.Sizeof(set.Bits[0])) * 8
+	set.Bits[w.fd/bits] |= 1 << (uint(w.fd) % uint(bits))
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+
+	n, err := syscall.Select(w.fd+1, &set, nil, nil, &tv)
+	if err != nil && err != syscall.EINTR {
+		debugLog("inotify select error: %v", err)
+		time.Sleep(timeout)
+		return
+	}
+
+	if n > 0 {
+		// discard events, the follower re-reads the file anyway
+		for {
+			if n, err := syscall.Read(w.fd, w.buf); n <= 0 || err != nil {
+				break
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) Close() error {
+	return syscall.Close(w.fd)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+func newFileWatcher(path string) fileWatcher {
+	return &pollWatcher{interval: 500 * time.Millisecond}
+}
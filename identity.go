@@ -0,0 +1,100 @@
+package main
+
+import (
+	"eximmon/exim"
+	"eximmon/whm"
+	"strings"
+)
+
+// ignoredLocalUsers are system accounts whose local submissions are never counted
+var ignoredLocalUsers = map[string]bool{
+	"root":              true,
+	"mailnull":          true,
+	"exim":              true,
+	"cpanel":            true,
+	"cpaneleximfilter":  true,
+	"cpaneleximscanner": true,
+	"cpanellogin":       true,
+	"dovecot":           true,
+	"mailman":           true,
+}
+
+// senderIdentity is who an outbound message is attributed to, either an
+// authenticated mailbox or a cPanel system user
+type senderIdentity struct {
+	Email string
+	User  string
+}
+
+// Key is the name counters are stored under
+func (s senderIdentity) Key() string {
+	if s.Email != "" {
+		return s.Email
+	}
+	return "user:" + s.User
+}
+
+func (s senderIdentity) String() string {
+	if s.Email != "" {
+		return s.Email
+	}
+	return "cPanel user " + s.User
+}
+
+// outboundIdentity attributes an arrival to the mailbox that authenticated,
+// or to the cPanel user for local submissions (sendmail from PHP, cron, ...)
+func outboundIdentity(entry exim.LogEntry) (senderIdentity, bool) {
+	if entry.Flag != exim.FlagArrival || len(entry.Recipients) == 0 {
+		return senderIdentity{}, false
+	}
+
+	if entry.Auth != "" {
+		id := entry.AuthenticatedID()
+		if strings.Index(id, "@") > 0 {
+			return senderIdentity{Email: id}, true
+		}
+		if id != "" {
+			// fixed_login, fixed_plain, courier with the cPanel username
+			return senderIdentity{User: id}, true
+		}
+		return senderIdentity{}, false
+	}
+
+	if strings.HasPrefix(entry.Protocol, "local") && entry.User != "" && !ignoredLocalUsers[entry.User] {
+		return senderIdentity{User: entry.User}, true
+	}
+
+	return senderIdentity{}, false
+}
+
+// senderDomain is the domain used to tell internal from external recipients
+func (s senderIdentity) senderDomain(entry exim.LogEntry) (string, error) {
+	if s.Email != "" {
+		return emailDomainName(s.Email)
+	}
+	return emailDomainName(entry.Address)
+}
+
+// parseIdentity reads an email address or cPanel username given on the command line
+func parseIdentity(name string) senderIdentity {
+	if strings.Contains(name, "@") {
+		return senderIdentity{Email: name}
+	}
+	return senderIdentity{User: strings.TrimPrefix(name, "user:")}
+}
+
+// suspendIdentity suspends outgoing email of a mailbox, or of the whole account
+func suspendIdentity(s senderIdentity) error {
+	if s.Email != "" {
+		return whm.SuspendEmail(s.Email)
+	}
+	return whm.SuspendUser(s.User)
+}
+
+// unsuspendIdentity reverts suspendIdentity
+func unsuspendIdentity(s senderIdentity) error {
+	if s.Email != "" {
+		return whm.UnSuspendEmail(s.Email)
+	}
+	return whm.UnsuspendUser(s.User)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"eximmon/exim"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// journalMatch selects exim messages from the journal
+var journalMatch = "SYSLOG_IDENTIFIER=exim"
+
+// journalFile is a saved `journalctl -o json` or `-o export` output to read
+// instead of running journalctl
+var journalFile = ""
+
+var eximDateReg = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`)
+
+// openJournalSource reads exim messages from journald, continuing after the
+// stored journal cursor, or from startTime when there is none
+func openJournalSource(cursor logCursor, startTime time.Time, follow bool) (LogSource, error) {
+	if journalFile != "" {
+		file, err := os.Open(journalFile)
+		if err != nil {
+			return nil, err
+		}
+		log("Reading journal export %s", journalFile)
+		return newStreamSource(func(emit func(string, string)) error {
+			return readJournal(file, cursor.Journal, emit)
+		}, file.Close), nil
+	}
+
+	args := []string{"-o", "json", "--no-pager"}
+	if journalMatch != "" {
+		args = append(args, journalMatch)
+	}
+	if cursor.Journal != "" {
+		args = append(args, "--after-cursor="+cursor.Journal)
+	} else if !startTime.IsZero() {
+		args = append(args, "--since=@"+strconv.FormatInt(startTime.Unix(), 10))
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+
+	cmd := exec.Command("journalctl", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to run journalctl: %v", err)
+	}
+	log("Reading journal: journalctl %s", strings.Join(args, " "))
+
+	return newStreamSource(func(emit func(string, string)) error {
+		if err := readJournal(out, "", emit); err != nil {
+			return err
+		}
+		return cmd.Wait()
+	}, func() error {
+		cmd.Process.Kill()
+		return nil
+	}), nil
+}
+
+// readJournal emits the exim lines of journal records in json or export
+// format. Records up to and including after are skipped.
+func readJournal(r io.Reader, after string, emit func(string, string)) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	skipping := after != ""
+	record := map[string]string{}
+
+	flush := func() {
+		if len(record) == 0 {
+			return
+		}
+		cursor := record["__CURSOR"]
+		if skipping {
+			if cursor == after {
+				skipping = false
+			}
+		} else if text := journalLine(record); text != "" {
+			emit(text, cursor)
+		}
+		record = map[string]string{}
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		if strings.HasPrefix(line, "{") {
+			// journalctl -o json, one record per line
+			fields, jerr := decodeJournalJSON(line)
+			if jerr != nil {
+				debugLog("Unable to decode journal record: %v", jerr)
+			} else {
+				record = fields
+				flush()
+			}
+		} else if line == "" {
+			// journalctl -o export, records end with an empty line
+			flush()
+		} else if i := strings.Index(line, "="); i > 0 {
+			record[line[:i]] = line[i+1:]
+		}
+
+		if err == io.EOF {
+			flush()
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeJournalJSON reads a json record, MESSAGE may be a byte array when
+// it is not valid UTF-8
+func decodeJournalJSON(line string) (map[string]string, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			fields[key] = v
+		case []interface{}:
+			b := make([]byte, 0, len(v))
+			for _, c := range v {
+				if f, ok := c.(float64); ok {
+					b = append(b, byte(f))
+				}
+			}
+			fields[key] = string(b)
+		}
+	}
+	return fields, nil
+}
+
+// journalLine returns the exim log line of a record, adding the journal
+// timestamp when exim logged to syslog without one
+func journalLine(record map[string]string) string {
+	text := record["MESSAGE"]
+	if text == "" || eximDateReg.MatchString(text) {
+		return text
+	}
+
+	usec, err := strconv.ParseInt(record["__REALTIME_TIMESTAMP"], 10, 64)
+	if err != nil {
+		return text
+	}
+	return time.UnixMicro(usec).In(exim.Location).Format("2006-01-02 15:04:05 -0700") + " " + text
+}
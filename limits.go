@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanLimits are the thresholds a sender gets suspended at, zero disables a limit
+type scanLimits struct {
+	MaxPerMin      int16
+	MaxPerHour     int16
+	MaxRcptPerMin  int64
+	MaxRcptPerHour int64
+	MinWindow      time.Duration // sliding windows of the per minute and per hour limits
+	HourWindow     time.Duration
+
+	MaxPerDay   int64 // calendar quotas, the week starts on Monday
+	MaxPerWeek  int64
+	MaxPerMonth int64
+
+	AccountMaxPerMin  int64 // totals of all senders of a cPanel account
+	AccountMaxPerHour int64
+	AccountMaxPerDay  int64
+
+	DomainMaxPerMin  int64 // totals of all mailboxes of a sending domain
+	DomainMaxPerHour int64
+	DomainMaxPerDay  int64
+	DomainLimits     map[string]DomainLimit // allowances of single domains
+
+	MaxFailureRatio  float64 // share of recipients bounced or deferred for the whole window
+	FailureMinSample int64
+	FailureWindow    time.Duration
+
+	MaxAuthFailPerIP      int64 // failed SMTP logins in the reject log
+	MaxAuthFailPerMailbox int64
+	AuthFailWindow        time.Duration
+}
+
+// envLimit reads a numeric limit from the environment
+func envLimit(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		panic(fmt.Errorf("Failed parsing %s: %+v", name, err))
+	}
+	return i
+}
+
+// envRatio reads a fraction like 0.5 from the environment
+func envRatio(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		panic(fmt.Errorf("Failed parsing %s: %+v", name, err))
+	}
+	return f
+}
+
+// domainLimit returns the limits of a sending domain, its allowance in
+// DomainLimits over the DOMAIN_MAX_* defaults
+func (l scanLimits) domainLimit(domain string) DomainLimit {
+	limit := DomainLimit{MaxPerMin: l.DomainMaxPerMin, MaxPerHour: l.DomainMaxPerHour, MaxPerDay: l.DomainMaxPerDay}
+	allowance, ok := l.DomainLimits[strings.ToLower(domain)]
+	if !ok {
+		return limit
+	}
+	if allowance.MaxPerMin != 0 {
+		limit.MaxPerMin = allowance.MaxPerMin
+	}
+	if allowance.MaxPerHour != 0 {
+		limit.MaxPerHour = allowance.MaxPerHour
+	}
+	if allowance.MaxPerDay != 0 {
+		limit.MaxPerDay = allowance.MaxPerDay
+	}
+	return limit
+}
+
+// over reports whether any enabled limit is exceeded
+func over(count int64, limit int64) bool {
+	return limit > 0 && count > limit
+}
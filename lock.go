@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockPath is held by the instance that scans logs and writes the cursors
+// and counters, it holds the PID and start time of that instance
+var lockPath = ".eximmon.lock"
+
+// instanceLock is the content of lockPath
+type instanceLock struct {
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// lockHandle stays open until the process exits, which releases the lock
+var lockHandle *os.File
+
+// acquireLock takes lockPath for command, failing with the running instance
+// when another one holds it
+func acquireLock(command string) error {
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", lockPath, err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		holder, readErr := readLock()
+		if readErr != nil || holder.PID == 0 {
+			return fmt.Errorf("%s is held by another instance: %v", lockPath, err)
+		}
+		return fmt.Errorf("eximmon %s is already running (pid %d since %s)",
+			holder.Command, holder.PID, holder.Started.Format("2006-01-02 15:04:05"))
+	}
+
+	// the lock is on the file itself, so it is rewritten in place and not renamed
+	data, err := json.Marshal(instanceLock{PID: os.Getpid(), Command: command, Started: time.Now()})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		file.Close()
+		return err
+	}
+	lockHandle = file
+	return nil
+}
+
+// readLock reads the instance holding lockPath
+func readLock() (instanceLock, error) {
+	var holder instanceLock
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return holder, err
+	}
+	err = json.Unmarshal(data, &holder)
+	return holder, err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile does not lock on this platform, so nothing keeps two instances apart
+func lockFile(file *os.File) error {
+	log("Unable to lock %s on this platform, make sure only one eximmon scans the logs", file.Name())
+	return nil
+}
+
+func waitLockFile(file *os.File) error {
+	log("Unable to lock %s on this platform, make sure only one eximmon changes it", file.Name())
+	return nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"eximmon/bot"
 	"eximmon/exim"
@@ -14,7 +13,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -24,12 +22,16 @@ var configPath = ".config"
 var dataPath = "data/"
 var botEngine *bot.Engine
 var debugMode = false
+var logSource = sourceFile
 
-// date, id, <=, email, extras
-var eximRegLine = regexp.MustCompile("(?i)(\\d{4}-\\d{2}-\\d{2} \\d{2}:\\d{2}:\\d{2}) ([^ ]*) ([^ ]*) .* A=dovecot_[a-zA-z]*:([^ ]*) (.*) for (.*)$")
 var notifyEmail = ""
 
 func main() {
+	// analyze prints its report on stdout, keep it clean
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		logOutput = os.Stderr
+	}
+
 	// Load config from file first
 	appConfig = loadConfig()
 	if appConfig != nil {
@@ -58,9 +60,23 @@ func main() {
 		log("")
 		log("Other environments variables:")
 		log("  MAX_PER_MIN=8 , MAX_PER_HOUR=100")
+		log("  MAX_RCPT_PER_MIN=50 , MAX_RCPT_PER_HOUR=500")
+		log("  MIN_WINDOW_SEC=60 , HOUR_WINDOW_MIN=60")
+		log("  MAX_PER_DAY=0 , MAX_PER_WEEK=0 , MAX_PER_MONTH=0")
+		log("  ACCOUNT_MAX_PER_MIN=0 , ACCOUNT_MAX_PER_HOUR=0 , ACCOUNT_MAX_PER_DAY=0")
+		log("  DOMAIN_MAX_PER_MIN=0 , DOMAIN_MAX_PER_HOUR=0 , DOMAIN_MAX_PER_DAY=0")
+		log("  MINUTE_RETENTION_DAYS=7 , HOUR_RETENTION_DAYS=90 , RETENTION_DAYS=365")
+		log("  MAX_FAILURE_RATIO=0.5 , FAILURE_MIN_SAMPLE=20 , FAILURE_WINDOW_MIN=60")
 		log("  NOTIFY_EMAIL=email , EXIM_LOG=/var/log/exim_mainlog")
+		log("  LOG_SOURCE=file|stdin|journald , JOURNAL_MATCH=SYSLOG_IDENTIFIER=exim , JOURNAL_FILE=")
+		log("  LOG_TIMEZONE=Asia/Jakarta")
+		log("  REJECT_LOG=/var/log/exim_rejectlog , AUTH_FAIL_MAX_PER_IP=20 , AUTH_FAIL_MAX_PER_MAILBOX=50 , AUTH_FAIL_WINDOW_MIN=10")
+		log("  AUTH_BLOCK_CMD='csf -d {ip} eximmon'")
 		log("  WHM_API_HOST=127.0.0.1")
 		log("  PREFER_MODERN_UAPI=true")
+		log("  FOLLOW_MODE=true")
+		log("  CONTAIN_SCRIPTS=false")
+		log("  ACTION_WORKERS=4 , ACTION_QUEUE=100")
 		log("")
 		log("Bot Integration:")
 		log("  TELEGRAM_BOT_TOKEN=xxx")
@@ -82,6 +98,14 @@ func main() {
 		log("Using modern UAPI with fallback to legacy WHM proxy")
 	}
 
+	// Follow mode keeps the log open instead of re-scanning every 15 seconds
+	followMode := os.Getenv("FOLLOW_MODE") != "false"
+
+	// Disable permissions of the PHP script that sent spam
+	if os.Getenv("CONTAIN_SCRIPTS") == "true" {
+		containScripts = true
+	}
+
 	// Debug mode
 	if os.Getenv("DEBUG") == "true" {
 		debugMode = true
@@ -109,6 +133,49 @@ func main() {
 		panic(fmt.Errorf("Max per hour must be above max per minutes"))
 	}
 
+	limits := scanLimits{
+		MaxPerMin:      maxPerMin,
+		MaxPerHour:     maxPerHour,
+		MaxRcptPerMin:  envLimit("MAX_RCPT_PER_MIN", 50),
+		MaxRcptPerHour: envLimit("MAX_RCPT_PER_HOUR", 500),
+		MinWindow:      time.Duration(envLimit("MIN_WINDOW_SEC", 60)) * time.Second,
+		HourWindow:     time.Duration(envLimit("HOUR_WINDOW_MIN", 60)) * time.Minute,
+
+		MaxPerDay:   envLimit("MAX_PER_DAY", 0),
+		MaxPerWeek:  envLimit("MAX_PER_WEEK", 0),
+		MaxPerMonth: envLimit("MAX_PER_MONTH", 0),
+
+		AccountMaxPerMin:  envLimit("ACCOUNT_MAX_PER_MIN", 0),
+		AccountMaxPerHour: envLimit("ACCOUNT_MAX_PER_HOUR", 0),
+		AccountMaxPerDay:  envLimit("ACCOUNT_MAX_PER_DAY", 0),
+
+		DomainMaxPerMin:  envLimit("DOMAIN_MAX_PER_MIN", 0),
+		DomainMaxPerHour: envLimit("DOMAIN_MAX_PER_HOUR", 0),
+		DomainMaxPerDay:  envLimit("DOMAIN_MAX_PER_DAY", 0),
+		DomainLimits:     loadDomainLimits(appConfig),
+
+		MaxFailureRatio:  envRatio("MAX_FAILURE_RATIO", 0.5),
+		FailureMinSample: envLimit("FAILURE_MIN_SAMPLE", 20),
+		FailureWindow:    time.Duration(envLimit("FAILURE_WINDOW_MIN", 60)) * time.Minute,
+
+		MaxAuthFailPerIP:      envLimit("AUTH_FAIL_MAX_PER_IP", 20),
+		MaxAuthFailPerMailbox: envLimit("AUTH_FAIL_MAX_PER_MAILBOX", 50),
+		AuthFailWindow:        time.Duration(envLimit("AUTH_FAIL_WINDOW_MIN", 10)) * time.Minute,
+	}
+
+	if limits.MinWindow <= 0 || limits.HourWindow < limits.MinWindow {
+		panic(fmt.Errorf("HOUR_WINDOW_MIN must be above MIN_WINDOW_SEC"))
+	}
+
+	counterRetention = retention{
+		MinuteDays: envLimit("MINUTE_RETENTION_DAYS", 7),
+		HourDays:   envLimit("HOUR_RETENTION_DAYS", 90),
+		Days:       envLimit("RETENTION_DAYS", 365),
+	}
+
+	// suspensions and notifications run on a worker pool, in order per sender
+	actions = newActionQueue(int(envLimit("ACTION_WORKERS", 4)), int(envLimit("ACTION_QUEUE", 100)))
+
 	if os.Getenv("EXIM_LOG") != "" {
 		logFile = os.Getenv("EXIM_LOG")
 	}
@@ -117,6 +184,42 @@ func main() {
 		notifyEmail = os.Getenv("NOTIFY_EMAIL")
 	}
 
+	switch os.Getenv("LOG_SOURCE") {
+	case "", sourceFile:
+	case sourceStdin, sourceJournald:
+		logSource = os.Getenv("LOG_SOURCE")
+	default:
+		panic(fmt.Errorf("Unknown LOG_SOURCE: %s", os.Getenv("LOG_SOURCE")))
+	}
+	if logFile == "-" {
+		logSource = sourceStdin
+	}
+	if os.Getenv("JOURNAL_MATCH") != "" {
+		journalMatch = os.Getenv("JOURNAL_MATCH")
+	}
+	if os.Getenv("JOURNAL_FILE") != "" {
+		journalFile = os.Getenv("JOURNAL_FILE")
+	}
+	patterns, err := loadLogPatterns(appConfig)
+	if err != nil {
+		panic(fmt.Errorf("Failed loading patterns: %+v", err))
+	}
+	logPatterns = patterns
+
+	if os.Getenv("LOG_TIMEZONE") != "" {
+		loc, err := time.LoadLocation(os.Getenv("LOG_TIMEZONE"))
+		if err != nil {
+			panic(fmt.Errorf("Failed loading LOG_TIMEZONE: %+v", err))
+		}
+		exim.Location = loc
+	}
+	if os.Getenv("REJECT_LOG") != "" {
+		rejectLog = os.Getenv("REJECT_LOG")
+	}
+	if os.Getenv("AUTH_BLOCK_CMD") != "" {
+		authBlockCmd = os.Getenv("AUTH_BLOCK_CMD")
+	}
+
 	if os.Getenv("WHM_API_HOST") != "" {
 		whm.ApiHost = os.Getenv("WHM_API_HOST")
 	}
@@ -125,6 +228,9 @@ func main() {
 
 	// Initialize bot engine
 	bot.Log = log
+	bot.Stats = func(name string) (string, error) {
+		return statsReport(name, limits)
+	}
 	botEngine = bot.NewEngine()
 	if botEngine != nil {
 		if err := botEngine.Start(); err != nil {
@@ -138,21 +244,49 @@ func main() {
 	}
 
 	if len(os.Args) < 2 {
-		log("args: start|run|skip|reset|suspend|unsuspend|info|config|help|test-notify|rerun|update")
+		log("args: start|run|skip|reset|suspend|unsuspend|stats|contain|uncontain|info|config|help|test-notify|rerun|update|parse-test|analyze|migrate|rekey|prune")
 		return
 	}
 
 	maxRun := -1
-	now := time.Now()
+	now := time.Now().In(exim.Location)
 	skipLastLine := false
 	//start from yesterday min
-	startTime := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Local().Location())
+	startTime := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, exim.Location)
+	//one instance at a time scans logs and writes the cursors and counters
+	switch os.Args[1] {
+	case "start", "run", "rerun", "skip", "reset", "migrate", "rekey", "prune":
+		if err := acquireLock(os.Args[1]); err != nil {
+			log("Refusing to %s: %v", os.Args[1], err)
+			os.Exit(1)
+		}
+	}
+	//counts a crash left in the counter log are saved before scanning again
+	switch os.Args[1] {
+	case "start", "run", "rerun", "skip":
+		if err := recoverCounters(); err != nil {
+			panic(fmt.Errorf("Unable to recover counters: %+v", err))
+		}
+		//the domains of cPanel accounts are read in the background, not while counting
+		if accountsEnabled(limits) {
+			accounts.refresh()
+		}
+	case "stats":
+		if err := loadCounterLog(); err != nil {
+			panic(fmt.Errorf("Unable to read counters: %+v", err))
+		}
+	}
+
 	switch os.Args[1] {
 	case "reset":
 		log("Removing %s*", dataPath)
 		tools.RemoveSubFileFolder(dataPath)
+		os.Remove(countersPath)
+		os.Remove(countersLogPath)
+		log("Removed %s", countersPath)
 		os.Remove(configPath)
 		log("Removed %s", configPath)
+		os.Remove(rejectCursorPath)
 		return
 	case "start":
 		//use yesterday
@@ -170,9 +304,18 @@ func main() {
 		if err != nil {
 			panic(fmt.Errorf("Unable to read date: %#v", os.Args[2]))
 		}
+		//messages counted before are skipped by their id
 		log("Rerun from: %s", thetime.Format(time.RFC3339))
-		if err := cleanupFrom(thetime); err != nil {
-			panic(fmt.Errorf("Unable to cleanup time: %+v", err))
+		if err := rates.seed(thetime, limits.HourWindow); err != nil {
+			panic(fmt.Errorf("Unable to read counters: %+v", err))
+		}
+		if logSource == sourceFile {
+			if err := scanLogArchives(logFile, thetime, limits); err != nil {
+				panic(fmt.Errorf("Unable to scan rotated logs: %+v", err))
+			}
+			if err := commitCounters("", logCursor{}); err != nil {
+				panic(fmt.Errorf("Unable to save counters: %+v", err))
+			}
 		}
 
 		startTime = thetime
@@ -182,11 +325,11 @@ func main() {
 		startTime = time.Now() //skip to now, skip everything then...
 	case "suspend":
 		if len(os.Args) < 3 {
-			log("suspend [email]")
+			log("suspend [email|cpanel user]")
 			return
 		}
 		email := os.Args[2]
-		if err := whm.SuspendEmail(email); err != nil {
+		if err := suspendIdentity(parseIdentity(email)); err != nil {
 			panic(fmt.Sprintf("error: %+v", err))
 		}
 
@@ -194,12 +337,12 @@ func main() {
 		return
 	case "unsuspend":
 		if len(os.Args) < 3 {
-			log("unsuspend [email]")
+			log("unsuspend [email|cpanel user]")
 			return
 		}
 
 		email := os.Args[2]
-		if err := whm.UnSuspendEmail(email); err != nil {
+		if err := unsuspendIdentity(parseIdentity(email)); err != nil {
 			panic(fmt.Sprintf("error: %+v", err))
 		}
 		log("Unsuspended %s", email)
@@ -216,6 +359,101 @@ func main() {
 		}
 		log("%#v", info)
 		return
+	case "stats":
+		if len(os.Args) < 3 {
+			log("stats [email|cpanel user|account:user|domain] [date]")
+			return
+		}
+		day := now
+		if len(os.Args) > 3 {
+			var err error
+			if day, err = exim.ParseDate(os.Args[3]); err != nil {
+				panic(fmt.Errorf("Unable to read date: %#v", os.Args[3]))
+			}
+		}
+		var err error
+		if isDomainName(os.Args[2]) {
+			err = printDomainStats(os.Args[2], day, limits)
+		} else {
+			err = printSenderStats(parseCounterKey(os.Args[2]), day, limits)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		releaseCounters()
+		return
+	case "migrate":
+		if err := migrateDataTree(dataPath); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		senders, err := knownSenders(logFile)
+		if err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := rekeyCounters(senders, nil); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := releaseCounters(); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
+	case "rekey":
+		assigned := map[string]string{}
+		for _, arg := range os.Args[2:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				log("rekey [old name=sender ...]")
+				return
+			}
+			assigned[parts[0]] = parts[1]
+		}
+		senders, err := knownSenders(logFile)
+		if err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := rekeyCounters(senders, assigned); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := releaseCounters(); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
+	case "prune":
+		if err := pruneCounters(now, counterRetention); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := releaseCounters(); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
+	case "contain":
+		if len(os.Args) < 3 {
+			log("contain [script path]")
+			return
+		}
+		//stored by absolute path, as the scanner contains them
+		path, err := filepath.Abs(os.Args[2])
+		if err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := containScript(path, "manual"); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
+	case "uncontain":
+		if len(os.Args) < 3 {
+			log("uncontain [script path]")
+			return
+		}
+		//stored by absolute path, as the scanner contains them
+		path, err := filepath.Abs(os.Args[2])
+		if err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		if err := uncontainScript(path); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
 	case "test-notify":
 		if err := notifySuspend("test@example.com", "a test"); err != nil {
 			log("notifySuspend error: %+v", err)
@@ -232,10 +470,43 @@ func main() {
 		log("  API_TOKEN: %s", maskToken(appConfig.API_TOKEN))
 		log("  NOTIFY_EMAIL: %s", appConfig.NOTIFY_EMAIL)
 		log("  EXIM_LOG: %s", appConfig.EXIM_LOG)
+		log("  LOG_SOURCE: %s", appConfig.LOG_SOURCE)
+		log("  JOURNAL_MATCH: %s", appConfig.JOURNAL_MATCH)
+		log("  JOURNAL_FILE: %s", appConfig.JOURNAL_FILE)
+		log("  LOG_TIMEZONE: %s", appConfig.LOG_TIMEZONE)
 		log("  WHM_API_HOST: %s", appConfig.WHM_API_HOST)
 		log("  MAX_PER_MIN: %d", appConfig.MAX_PER_MIN)
 		log("  MAX_PER_HOUR: %d", appConfig.MAX_PER_HOUR)
+		log("  MAX_RCPT_PER_MIN: %d", appConfig.MAX_RCPT_PER_MIN)
+		log("  MAX_RCPT_PER_HOUR: %d", appConfig.MAX_RCPT_PER_HOUR)
+		log("  MIN_WINDOW_SEC: %d", appConfig.MIN_WINDOW_SEC)
+		log("  HOUR_WINDOW_MIN: %d", appConfig.HOUR_WINDOW_MIN)
+		log("  MAX_PER_DAY: %d", appConfig.MAX_PER_DAY)
+		log("  MAX_PER_WEEK: %d", appConfig.MAX_PER_WEEK)
+		log("  MAX_PER_MONTH: %d", appConfig.MAX_PER_MONTH)
+		log("  ACCOUNT_MAX_PER_MIN: %d", appConfig.ACCOUNT_MAX_PER_MIN)
+		log("  ACCOUNT_MAX_PER_HOUR: %d", appConfig.ACCOUNT_MAX_PER_HOUR)
+		log("  ACCOUNT_MAX_PER_DAY: %d", appConfig.ACCOUNT_MAX_PER_DAY)
+		log("  DOMAIN_MAX_PER_MIN: %d", appConfig.DOMAIN_MAX_PER_MIN)
+		log("  DOMAIN_MAX_PER_HOUR: %d", appConfig.DOMAIN_MAX_PER_HOUR)
+		log("  DOMAIN_MAX_PER_DAY: %d", appConfig.DOMAIN_MAX_PER_DAY)
+		log("  DOMAIN_LIMITS: %d domains", len(appConfig.DOMAIN_LIMITS))
+		log("  MINUTE_RETENTION_DAYS: %d", appConfig.MINUTE_RETENTION_DAYS)
+		log("  HOUR_RETENTION_DAYS: %d", appConfig.HOUR_RETENTION_DAYS)
+		log("  RETENTION_DAYS: %d", appConfig.RETENTION_DAYS)
+		log("  MAX_FAILURE_RATIO: %s", appConfig.MAX_FAILURE_RATIO)
+		log("  FAILURE_MIN_SAMPLE: %d", appConfig.FAILURE_MIN_SAMPLE)
+		log("  FAILURE_WINDOW_MIN: %d", appConfig.FAILURE_WINDOW_MIN)
+		log("  REJECT_LOG: %s", appConfig.REJECT_LOG)
+		log("  AUTH_FAIL_MAX_PER_IP: %d", appConfig.AUTH_FAIL_MAX_PER_IP)
+		log("  AUTH_FAIL_MAX_PER_MAILBOX: %d", appConfig.AUTH_FAIL_MAX_PER_MAILBOX)
+		log("  AUTH_FAIL_WINDOW_MIN: %d", appConfig.AUTH_FAIL_WINDOW_MIN)
+		log("  AUTH_BLOCK_CMD: %s", appConfig.AUTH_BLOCK_CMD)
 		log("  PREFER_MODERN_UAPI: %s", appConfig.PREFER_MODERN_UAPI)
+		log("  FOLLOW_MODE: %s", appConfig.FOLLOW_MODE)
+		log("  CONTAIN_SCRIPTS: %s", appConfig.CONTAIN_SCRIPTS)
+		log("  ACTION_WORKERS: %d", appConfig.ACTION_WORKERS)
+		log("  ACTION_QUEUE: %d", appConfig.ACTION_QUEUE)
 		log("")
 		log("Bot config:")
 		log("  TELEGRAM_BOT_TOKEN: %s", maskToken(appConfig.TELEGRAM_BOT_TOKEN))
@@ -253,18 +524,45 @@ func main() {
 		}
 		return
 
+	case "analyze":
+		if len(os.Args) < 3 {
+			log("analyze [file|-] [--json]")
+			return
+		}
+		asJSON := len(os.Args) > 3 && os.Args[3] == "--json"
+		if err := analyzeLog(os.Args[2], limits, asJSON); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
+	case "parse-test":
+		if len(os.Args) < 3 {
+			log("parse-test [file|-]")
+			return
+		}
+		if err := parseTest(os.Args[2]); err != nil {
+			panic(fmt.Sprintf("error: %+v", err))
+		}
+		return
 	case "help":
-		log("start - continue from last position or start from yesterday, and repeats from last position")
-		log("rerun - rerun from specified date")
+		log("start - continue from last position or start from yesterday, and follows new lines")
+		log("rerun - rerun from specified date, including rotated and compressed logs, counting messages not counted yet")
 		log("run - continue from last position or start from beginning for one time")
 		log("skip - skip all existing data and repeats for new logs")
 		log("reset - reset all data, huh, what?")
-		log("suspend - suspend outgoing email")
-		log("unsuspend - unsuspend outgoing email")
+		log("suspend - suspend outgoing email of a mailbox, or of a whole cPanel user")
+		log("unsuspend - unsuspend outgoing email of a mailbox, or of a whole cPanel user")
+		log("stats - hourly volume and delivery outcomes of a sender")
+		log("contain - remove permissions of a spamming script")
+		log("uncontain - restore permissions of a contained script")
 		log("info - get information of a domain")
 		log("config - show current configuration")
 		log("update - download and install latest version")
 		log("test-notify - test send notification mail")
+		log("migrate - import the counters of the data/ directory of earlier versions")
+		log("rekey - move counters of earlier versions to their sender, reporting the ambiguous ones")
+		log("prune - roll up and delete counters past their retention, start does it daily")
+		log("analyze - report volumes and would-be violations of a log, without counting or suspending")
+		log("parse-test - show matched lines, extracted fields and skipped lines of a log file")
 		log("help - this!")
 		return
 
@@ -272,271 +570,479 @@ func main() {
 		panic(fmt.Errorf("Unknown command: %s", os.Args[1]))
 	}
 
+	//the sliding windows go on from the counters stored before the scan resumes
+	if os.Args[1] != "rerun" {
+		cursor, err := loadCursor(configPath, logFile)
+		if err != nil {
+			panic(err)
+		}
+		if err := rates.seed(cursorTime(cursor, startTime), limits.HourWindow); err != nil {
+			panic(fmt.Errorf("Unable to read counters: %+v", err))
+		}
+	}
+
+	follow := followMode && maxRun < 0
+	if follow {
+		log("Following %s for new lines", logFile)
+	}
+
+	//failed logins are only in the reject log file
+	scanReject := logSource == sourceFile && rejectLog != "off"
+	if scanReject && follow {
+		go func() {
+			for {
+				if err := scanRejectLog(rejectLog, limits, true); err != nil {
+					log("reject log scanner error: %+v", err)
+				}
+				time.Sleep(15 * time.Second)
+			}
+		}()
+	}
+
+	//counters past their retention are rolled up or deleted once a day
+	if maxRun < 0 {
+		go func() {
+			for {
+				if err := pruneCounters(time.Now().In(exim.Location), counterRetention); err != nil {
+					log("prune error: %+v", err)
+				}
+				time.Sleep(24 * time.Hour)
+			}
+		}()
+	}
+
 	i := 1
 	for {
 		log("loop %d", i)
-		if err := eximLogScanner(logFile, startTime, maxPerMin, maxPerHour, skipLastLine); err != nil {
+		if err := eximLogScanner(logFile, startTime, limits, skipLastLine, follow); err != nil {
 			log("log scanner error: %+v", err)
 			// time.sleep(15 * time.Second)
 		}
+		if scanReject && !follow {
+			if err := scanRejectLog(rejectLog, limits, false); err != nil {
+				log("reject log scanner error: %+v", err)
+			}
+		}
+		actions.wait()
 
 		if maxRun > -1 && i > maxRun {
 			break
 		}
+		//a piped stream or saved journal is read once
+		if logSource == sourceStdin || (logSource == sourceJournald && journalFile != "") {
+			break
+		}
+		//continue from stored position on the next loop
+		skipLastLine = false
 		time.Sleep(15 * time.Second)
 		i++
 	} //loop
 
+	if err := closeCounters(); err != nil {
+		log("Unable to save counters: %+v", err)
+	}
 	log("Done.")
 }
 
-func cleanupFrom(thetime time.Time) error {
-	t := thetime
-	log("Cleaning data from: %v", t.Format(time.RFC3339))
-	d, err := os.Open(dataPath)
-	if err != nil {
-		return err
-	}
-	defer d.Close()
-	names, err := d.Readdirnames(-1)
-	if err != nil {
-		return err
+func emailDomainName(email string) (string, error) {
+	trimmedEmail := strings.TrimSpace(email)
+	lastPos := strings.LastIndex(trimmedEmail, "@")
+	if lastPos < 0 {
+		return "", fmt.Errorf("@ missing, not valid email: " + email)
 	}
-	for _, name := range names {
-		ownerDir := filepath.Join(dataPath, name)
-		debugLog("scanning: %+v", ownerDir)
 
-		d, err := os.Open(ownerDir)
+	domain := trimmedEmail[lastPos+1:]
+	debugLog("domain %s, email: %s", domain, email)
+
+	return domain, nil
+}
+
+func eximLogScanner(logFile string, startTime time.Time, limits scanLimits, skipLastLine bool, follow bool) error {
+	cursor := logCursor{}
+
+	if !skipLastLine {
+		var err error
+		cursor, err = loadCursor(configPath, logFile)
 		if err != nil {
+			panic(err)
+		}
+	}
+
+	startTime = cursorTime(cursor, startTime)
+
+	var source LogSource
+	prefix := ""
+	switch logSource {
+	case sourceStdin:
+		log("Scanning stdin from time: %v", startTime.Format(time.RFC3339))
+		source = newStdinSource()
+		//read until the stream ends
+		follow = true
+	case sourceJournald:
+		var err error
+		if source, err = openJournalSource(cursor, startTime, follow); err != nil {
 			return err
 		}
-		defer d.Close()
-		dates, err := d.Readdirnames(-1)
-		if err != nil {
+		if cursor.Journal != "" {
+			prefix = cursor.Prefix
+		}
+		follow = true
+	default:
+		var err error
+		if source, prefix, err = openFileSource(logFile, cursor, startTime, limits); err != nil {
 			return err
 		}
-		for _, date := range dates {
-			dateDir := filepath.Join(ownerDir, date)
+	}
+	defer source.Close()
 
-			dirtime, err := time.Parse("2006_01_02", date)
-			// thetime, err := exim.ParseDate(os.Args[2])
-			if err != nil {
-				panic(fmt.Errorf("Unable to read date: %#v", date))
-			}
+	log("Starting line %d time: %v", source.LineNo()+1, startTime.Format(time.RFC3339))
 
-			if !t.After(dirtime) {
-				debugLog("removing: %+v", dateDir)
+	if err := scanLines(source, prefix, startTime, limits, follow); err != nil {
+		return err
+	}
 
-				err = os.RemoveAll(dateDir)
-				if err != nil {
-					return err
-				}
-			} else {
-				debugLog("not removing: %+v", dateDir)
-			}
+	log("ended: line %d", source.LineNo())
+	return nil
+}
 
-		} //each date
+// cursorTime is the time of the last line at cursor, startTime without one
+func cursorTime(cursor logCursor, startTime time.Time) time.Time {
+	if len(cursor.Prefix) < 19 {
+		return startTime
+	}
+	log("parsing last time: %s", cursor.Prefix)
+	thetime, _, err := exim.ParseTimestamp(cursor.Prefix)
+	if err != nil {
+		log("Unable to read lastPrefix date: %#v on line %d", thetime, cursor.Prefix)
+		// panic(fmt.Errorf("Unable to read lastPrefix date: %#v on line %d", startTime, lastPrefix))
+		return time.Now()
+	}
+	return thetime
+}
 
-	} //each owner
+// openFileSource opens logFile at the stored cursor, after finishing the
+// rotated log the cursor points to. It returns the prefix of the last line.
+func openFileSource(logFile string, cursor logCursor, startTime time.Time, limits scanLimits) (LogSource, string, error) {
+	follower, err := openLogFollower(logFile)
+	if err != nil {
+		return nil, "", err
+	}
 
-	// t = t.AddDate(0, 0, 1)
-	return nil
+	log("Scanning log from time: %v, last line %v path: %v", startTime.Format(time.RFC3339), cursor.Line, logFile)
+
+	prefix := ""
+	if cursor.Offset > 0 {
+		if cursor.Device == follower.device && cursor.Inode == follower.inode {
+			resumed, err := follower.Resume(cursor)
+			if err != nil {
+				follower.Close()
+				return nil, "", err
+			}
+			if resumed {
+				prefix = cursor.Prefix
+			} else {
+				time.Sleep(10 * time.Second)
+				//resetting to start
+			}
+		} else {
+			rotatedLog, err := findRotatedLog(logFile, cursor)
+			if err != nil {
+				follower.Close()
+				return nil, "", err
+			}
+			if rotatedLog == "" {
+				log("Rotated log for last position not found, starting %s from the beginning", logFile)
+			} else if err := scanRotatedLog(rotatedLog, cursor, startTime, limits); err != nil {
+				follower.Close()
+				return nil, "", err
+			}
+		}
+	}
+
+	return follower, prefix, nil
 }
 
-func emailDomainName(email string) (string, error) {
-	trimmedEmail := strings.TrimSpace(email)
-	lastPos := strings.LastIndex(trimmedEmail, "@")
-	if lastPos < 0 {
-		return "", fmt.Errorf("@ missing, not valid email: " + email)
+// scanRotatedLog finishes the part of a rotated log written after the cursor
+func scanRotatedLog(path string, cursor logCursor, startTime time.Time, limits scanLimits) error {
+	log("Finishing rotated log %s from offset %d", path, cursor.Offset)
+	follower, err := openLogFollower(path)
+	if err != nil {
+		return err
 	}
+	defer follower.Close()
 
-	domain := trimmedEmail[lastPos+1:]
-	debugLog("domain %s, email: %s", domain, email)
+	resumed, err := follower.Resume(cursor)
+	if err != nil {
+		return err
+	}
+	if !resumed {
+		log("Rotated log %s does not match last position, skipping", path)
+		return nil
+	}
 
-	return domain, nil
+	return scanLines(follower, cursor.Prefix, startTime, limits, false)
 }
 
-func eximLogScanner(logFile string, startTime time.Time, maxPerMin int16, maxPerHour int16, skipLastLine bool) error {
-	lastLine := int64(0)
-	lastPrefix := ""
+// scanLines counts lines from source and stores the cursor each time it
+// catches up. When follow is set it waits for new lines until the source ends.
+func scanLines(source LogSource, prefix string, startTime time.Time, limits scanLimits, follow bool) error {
+	pipeline := newScanPipeline(startTime, limits, follow)
+	err := scanSource(source, configPath, prefix, follow, pipeline.feed, pipeline.flush)
+	pipeline.close()
+	if err == nil {
+		err = pipeline.finish()
+	}
+	if err != nil {
+		//the lines after the stored cursor are counted again on the next loop
+		if err := rollbackCounters(); err != nil {
+			log("Unable to drop uncommitted counters: %+v", err)
+		}
+	}
+	return err
+}
 
-	if !skipLastLine {
-		var err error
-		_, lastLine, lastPrefix, err = lastConfig(logFile)
-		if err != nil {
-			panic(err)
+// scanSource hands every line of source to handle, storing the cursor at
+// cursorPath each time it catches up. When flush is set it stores the cursor,
+// together with what handle counted.
+func scanSource(source LogSource, cursorPath string, prefix string, follow bool, handle func(text string, lineNo int64) error, flush func(cursorPath string, cursor logCursor) error) error {
+	stored := source.Cursor(prefix)
+	for {
+		text, err := source.ReadLine()
+		if err == io.EOF {
+			if cursor := source.Cursor(prefix); flush != nil {
+				if err := flush(cursorPath, cursor); err != nil {
+					return err
+				}
+			} else if cursor != stored {
+				if err := storeCursor(cursorPath, cursor); err != nil {
+					log("Unable to store position: %+v", err)
+				}
+				stored = cursor
+			}
+			if !follow {
+				return nil
+			}
+
+			rotated, err := source.Wait()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if rotated {
+				prefix = ""
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		prefix = linePrefix(text)
+		if err := handle(text, source.LineNo()); err != nil {
+			return err
 		}
+	}
+}
 
-		lastPrefix = strings.TrimRight(lastPrefix, "\n")
+// linePrefix is the part of a log line stored in the cursor to recognise it,
+// long enough to hold a timestamp with milliseconds and timezone
+func linePrefix(text string) string {
+	n := 25
+	if _, length, err := exim.ParseTimestamp(text); err == nil && length+6 > n {
+		n = length + 6
+	}
+	if len(text) > n {
+		return text[0:n]
 	}
+	return text
+}
 
-	newSize := MustSize(logFile)
-	file, err := os.Open(logFile)
+// countLogLine counts a single exim log line and suspends the sender when over limit
+func countLogLine(text string, lineNo int64, startTime time.Time, limits scanLimits) error {
+	entry, _, err := exim.ParseLineWith(text, logPatterns)
 	if err != nil {
-		panic(err)
+		debugLog("Not: %v | %v", err, text)
+		return nil
 	}
-	defer file.Close()
+	return countEntry(entry, startTime, limits)
+}
 
-	//checks if line still valid
-	scanner := bufio.NewScanner(file)
-	lineNo := int64(1)
+// countEntry counts a parsed log line and queues the suspension of its sender when over limit
+func countEntry(entry exim.LogEntry, startTime time.Time, limits scanLimits) error {
+	var err error
+	if entry.Cwd != "" {
+		scripts.seen(entry)
+		return nil
+	}
 
-	if lastPrefix != "" {
-		var err error
-		log("parsing last time: %s", lastPrefix[:19])
-		startTime, err = exim.ParseDate(lastPrefix[:19])
-		if err != nil {
-			log("Unable to read lastPrefix date: %#v on line %d", startTime, lastPrefix)
-			// panic(fmt.Errorf("Unable to read lastPrefix date: %#v on line %d", startTime, lastPrefix))
-			startTime = time.Now()
-		}
+	if msg, first := messages.Add(entry); msg != nil && entry.Flag != exim.FlagArrival {
+		return countOutcome(entry, msg, first, startTime, limits)
 	}
 
-	for scanner.Scan() {
-		if lineNo >= lastLine {
-			break
+	sender, ok := outboundIdentity(entry)
+	if !ok {
+		if strings.Contains(entry.Raw, "A=") {
+			debugLog("Not: %#v | %v", entry.Flag, entry.Raw)
 		}
+		return nil
+	}
 
-		// log("Skipping: %d: %d", lineNo, scanner.Text())
-		lineNo++
+	script := ""
+	scriptExact := false
+	if sender.User != "" && strings.HasPrefix(entry.Protocol, "local") {
+		script, scriptExact = scripts.attach(entry)
 	}
 
-	log("Scanning log from time: %v, last line %v path: %v", startTime.Format(time.RFC3339), lastLine, logFile)
+	email := sender.Key()
+	recipient := strings.Join(entry.Recipients, " ")
+	thetime := entry.Time
+	process := true
+	skipTime := false
+	var senderDomain string
+	var recipientDomain string
+	externalCount := int64(0)
+
+	if !startTime.IsZero() {
+		if thetime.Before(startTime) {
+			debugLog("Skipping by time %s expected %s", thetime.Format(time.RFC3339), startTime.Format(time.RFC3339))
+			skipTime = true
+			process = false
+		}
+	}
 
-	text := scanner.Text()
-	if lastLine > 0 {
-		if !strings.HasPrefix(text, lastPrefix) {
-			log("Last missing line:\n%s\nExpecting:\n%s\n", text, lastPrefix)
-			time.Sleep(10 * time.Second)
-			//resetting to start
-			_, lastLine, lastPrefix = 0, 0, ""
-			if _, err := file.Seek(0, io.SeekStart); err != nil {
-				return err
+	if process {
+		senderDomain, err = sender.senderDomain(entry)
+		if err != nil {
+			debugLog("unable to obtain sender domain of %s: %v", sender, err)
+		}
+		for _, rec := range entry.Recipients {
+			recipientDomain, err = emailDomainName(rec)
+			if err != nil {
+				debugLog("unable to obtain domain from email %s, error: %v", err, rec)
+				continue
 			}
-			scanner = bufio.NewScanner(file) //reset scanner
-			scanner.Scan()
-			lineNo = 1
-		} else {
-			//skip to next line
-			if !scanner.Scan() {
-				log("No new line since last scan")
-				return nil
+			if senderDomain == recipientDomain {
+				debugLog("detected same domain %s | %s", email, rec)
+				continue
 			}
-			lineNo++
+			debugLog("detected other domain %s | %s", recipientDomain, rec)
+			externalCount++
 		}
+
+		process = externalCount > 0
 	}
 
-	if err := scanner.Err(); err != nil {
-		panic(err)
+	if process && entry.MessageID != "" {
+		if first, err := countOnce(thetime, entry.MessageID); err != nil {
+			return err
+		} else if !first {
+			debugLog("Already counted %s of %s", entry.MessageID, email)
+			return nil
+		}
 	}
 
-	log("Starting line %d time: %v", lineNo, startTime.Format(time.RFC3339))
+	if process {
+		minCount, hourCount, err := mailCount(thetime, email)
+		if err != nil {
+			return err
+		}
+		minCount++
+		hourCount++
 
-	for {
-		text = scanner.Text()
-		debugLog("raw line %d: %v", lineNo, text)
-		res := eximRegLine.FindStringSubmatch(text)
-		if len(res) < 5 {
-			if strings.Contains(text, "A=dovecot") {
-				debugLog("Not: %#v | %v", res, text)
-				time.Sleep(100 * time.Millisecond)
-			}
-		} else {
-			if res[3] == "<=" {
-				email := res[4] //login owner
-				recipient := res[6]
-				process := false
-				skipTime := false
-				var thetime time.Time
-				var err error
-				var senderDomain string
-				var recipientDomain string
-
-				thetime, err = exim.ParseDate(res[1])
-				if err != nil {
-					panic(fmt.Errorf("Unable to read date: %#v on line %d", thetime, lineNo))
-				}
-				if !startTime.IsZero() {
-					if thetime.Before(startTime) {
-						debugLog("Skipping by time %s expected %s", thetime.Format(time.RFC3339), startTime.Format(time.RFC3339))
-						skipTime = true
-					}
-				}
+		if err := mailCountStore(thetime, email, hourCount, minCount); err != nil {
+			panic(fmt.Errorf("Unable to save count %s, time: %#v, error: %#v", email, thetime, err))
+		}
 
-				if !skipTime && strings.Index(email, "@") > 0 {
-					process = true
-				} //is email
+		rcptMin, rcptHour, err := recipientCount(thetime, email)
+		if err != nil {
+			return err
+		}
+		rcptMin += externalCount
+		rcptHour += externalCount
 
-				if process {
-					senderDomain, err = emailDomainName(email)
-					if err != nil {
-						return fmt.Errorf("unable to obtain domain from email %s, error: %v", err, email)
-					}
-					hasExternal := false
-					recipients := strings.Split(recipient, " ")
-					for _, rec := range recipients {
-						recipientDomain, err = emailDomainName(rec)
-						if err != nil {
-							debugLog("unable to obtain domain from email %s, error: %v", err, rec)
-							continue
-						}
-						if senderDomain == recipientDomain {
-							debugLog("detected same domain %s | %s", email, rec)
-							continue
-						}
-						debugLog("detected other domain %s | %s", recipientDomain, rec)
-						hasExternal = true
-					}
+		if err := recipientCountStore(thetime, email, rcptHour, rcptMin); err != nil {
+			panic(fmt.Errorf("Unable to save recipient count %s, time: %#v, error: %#v", email, thetime, err))
+		}
 
-					process = hasExternal
-				}
+		if script != "" {
+			scriptMin, scriptHour, err := mailCount(thetime, scriptKey(script))
+			if err != nil {
+				return err
+			}
+			if err := mailCountStore(thetime, scriptKey(script), scriptHour+1, scriptMin+1); err != nil {
+				panic(fmt.Errorf("Unable to save count %s, time: %#v, error: %#v", script, thetime, err))
+			}
+			log("Counted script %s: min=%d, hour=%d", script, scriptMin+1, scriptHour+1)
+		}
 
-				if process {
-					minCount, hourCount, err := mailCount(thetime, email)
-					if err != nil {
-						return err
-					}
-					minCount++
-					hourCount++
-					//TODO save based on X recipients per email?
+		// limits apply to sliding windows, the calendar counters above are for stats
+		rates.add(email, thetime, externalCount, limits.HourWindow)
+		lastMin := rates.count(email, thetime, limits.MinWindow)
+		lastHour := rates.count(email, thetime, limits.HourWindow)
 
-					if err := mailCountStore(thetime, email, hourCount, minCount); err != nil {
-						panic(fmt.Errorf("Unable to save count %s, time: %#v, error: %#v", email, thetime, err))
-					}
+		quota := quotaCounts{}
+		if quotasEnabled(limits) {
+			if quota, err = quotaCount(thetime, email); err != nil {
+				return err
+			}
+		}
 
-					if minCount > int64(maxPerMin) || hourCount > int64(maxPerHour) {
-						if err := whm.SuspendEmail(email); err != nil {
-							log("Unable to suspendEmail %s, error: %+v", email, err)
-							time.Sleep(5 * time.Second)
-						}
-
-						if notifyEmail != "" {
-							if err = notifySuspend(email, fmt.Sprintf("Count: minute: %d, hour: %d", minCount, hourCount)); err != nil {
-								log("notifySuspend error: %+v", err)
-								time.Sleep(10 * time.Second)
-							}
-						}
+		if lastMin.Messages > int64(limits.MaxPerMin) || lastHour.Messages > int64(limits.MaxPerHour) ||
+			over(lastMin.Recipients, limits.MaxRcptPerMin) || over(lastHour.Recipients, limits.MaxRcptPerHour) ||
+			quota.exceeded(limits) {
+			message := fmt.Sprintf("Count: last %s: %d, last %s: %d\nRecipients: last %s: %d, last %s: %d",
+				limits.MinWindow, lastMin.Messages, limits.HourWindow, lastHour.Messages,
+				limits.MinWindow, lastMin.Recipients, limits.HourWindow, lastHour.Recipients)
+			if quotasEnabled(limits) {
+				message += "\nQuota: " + quota.format(limits)
+			}
+			if script != "" {
+				message += fmt.Sprintf("\nScript: %s", script)
+				if containScripts && scriptExact {
+					if err := containScript(script, sender.String()); err != nil {
+						log("Unable to contain script %s: %+v", script, err)
+					} else {
+						message += " (contained, undo: eximmon uncontain " + script + ")"
 					}
-
-					log("Counted %s: min=%d, hour=%d", email, minCount, hourCount)
-				} else if !skipTime {
-					debugLog("Ignoring internal email: %s -> %s", email, recipient)
+				} else if containScripts {
+					message += " (not contained, the script path is not certain)"
 				}
 			}
+
+			suspendSender(sender, message)
 		}
-		if !scanner.Scan() {
-			// log("scanned ended: line %d", lineNo)
-			break
+
+		if err := countAccount(sender, thetime, externalCount, limits); err != nil {
+			return err
+		}
+		if err := countDomain(sender, senderDomain, thetime, externalCount, limits); err != nil {
+			return err
 		}
-		lineNo++
-	}
 
-	log("ended: line %d", lineNo)
+		log("Counted %s: min=%d, hour=%d, recipients min=%d, hour=%d, last %s=%d, last %s=%d", sender, minCount, hourCount, rcptMin, rcptHour,
+			limits.MinWindow, lastMin.Messages, limits.HourWindow, lastHour.Messages)
+	} else if !skipTime {
+		debugLog("Ignoring internal email: %s -> %s", email, recipient)
+	}
+	return nil
+}
 
-	lastPrefix = text[0:25]
+// suspendSender queues the suspension of sender's outgoing mail and the
+// notification, so a slow WHM call does not hold up counting
+func suspendSender(sender senderIdentity, message string) {
+	actions.submit(sender.Key(), func() {
+		if err := suspendIdentity(sender); err != nil {
+			log("Unable to suspend %s, error: %+v", sender, err)
+			time.Sleep(5 * time.Second)
+		}
 
-	storeConfig(logFile, newSize, lineNo, lastPrefix)
-	return nil
+		if notifyEmail != "" {
+			if err := notifySuspend(sender.String(), message); err != nil {
+				log("notifySuspend error: %+v", err)
+				time.Sleep(10 * time.Second)
+			}
+		}
+	})
 }
 
 func notifySuspend(email string, message string) error {
@@ -577,117 +1083,22 @@ func notifySuspend(email string, message string) error {
 }
 
 func mailCountStore(thetime time.Time, email string, hourCount int64, minCount int64) error {
-	path := dataPath + cleanPath(email)
-
-	dirPath := cleanPath(thetime.Format("2006-01-02"))
-	hourPath := thetime.Format("15")
-	minPath := thetime.Format("1504")
-
-	datePath := path + "/" + dirPath
-	hourFile := datePath + "/" + hourPath
-	minFile := datePath + "/" + minPath
-
-	MustDir(datePath)
-
-	debugLog("Writing %s/%s", dirPath, hourFile)
-	if err := ioutil.WriteFile(hourFile, []byte(fmt.Sprintf("%d", hourCount)), 0644); err != nil {
-		return err
-	}
-	debugLog("Writing %s", minFile)
-	if err := ioutil.WriteFile(minFile, []byte(fmt.Sprintf("%d", minCount)), 0644); err != nil {
-		return err
-	}
-	return nil
+	return counterStore(thetime, email, "", hourCount, minCount)
 }
 
 // this minute, this hour count
 func mailCount(thetime time.Time, email string) (int64, int64, error) {
-	path := dataPath + cleanPath(email)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		// path/to/whatever does not exist
-		return 0, 0, nil
-	}
-
-	dirPath := cleanPath(thetime.Format("2006-01-02"))
-	// hourPath := now.Format("150405")
-	hourPath := thetime.Format("15")
-	minPath := thetime.Format("1504")
-
-	datePath := path + "/" + dirPath
-	if _, err := os.Stat(datePath); os.IsNotExist(err) {
-		// path/to/whatever does not exist
-		return 0, 0, nil
-	}
-
-	if _, err := os.Stat(datePath); os.IsNotExist(err) {
-		// path/to/whatever does not exist
-		return 0, 0, nil
-	}
-
-	hourCount := int64(0)
-	minCount := int64(0)
-	hourFile := datePath + "/" + hourPath
-	minFile := datePath + "/" + minPath
-
-	if _, err := os.Stat(hourFile); !os.IsNotExist(err) {
-		content, err := ioutil.ReadFile(hourFile)
-		if err != nil {
-			return 0, 0, err
-		}
-		hourCount, err = strconv.ParseInt(string(content), 0, 64)
-		if err != nil {
-			return 0, 0, err
-		}
-	}
-	if _, err := os.Stat(minFile); !os.IsNotExist(err) {
-		content, err := ioutil.ReadFile(minFile)
-		if err != nil {
-			return 0, 0, err
-		}
-		minCount, err = strconv.ParseInt(string(content), 0, 64)
-		if err != nil {
-			return 0, 0, err
-		}
-	}
-
-	return minCount, hourCount, nil
+	return counterRead(thetime, email, "")
 }
 
-func storeConfig(logFile string, size int64, line int64, prefix string) error {
-	return ioutil.WriteFile(configPath, []byte(fmt.Sprintf("%d||%d||%s", size, line, prefix)), 0644)
+// recipientCountStore stores external recipients next to the message counts
+func recipientCountStore(thetime time.Time, email string, hourCount int64, minCount int64) error {
+	return counterStore(thetime, email, ".rcpt", hourCount, minCount)
 }
 
-//last size, last line#, prefix
-func lastConfig(logFile string) (int64, int64, string, error) {
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		// path/to/whatever does not exist
-		return 0, 0, "", nil
-	}
-
-	content, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return 0, 0, "", err
-	}
-
-	args := strings.Split(string(content), "||")
-	size, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return 0, 0, "", err
-	}
-	line, err := strconv.ParseInt(args[1], 10, 64)
-	if err != nil {
-		return 0, 0, "", err
-	}
-	prefix := args[2]
-
-	newSize := MustSize(logFile)
-	if newSize < size {
-		log("Size shrinked: %f, expected: %f", newSize, size)
-		time.Sleep(10 * time.Second)
-		return 0, 0, "", nil //reset
-	}
-
-	return size, line, prefix, nil
+// this minute, this hour external recipients
+func recipientCount(thetime time.Time, email string) (int64, int64, error) {
+	return counterRead(thetime, email, ".rcpt")
 }
 
 func cleanPath(name string) string {
@@ -709,22 +1120,16 @@ func MustDir(path string) {
 	}
 }
 
-func MustSize(path string) int64 {
-	fi, err := os.Stat(path)
-	if err != nil {
-		panic(fmt.Errorf("Unable to state %s, error: %+v", path, err))
-	}
-
-	return fi.Size()
-}
+// logOutput is stdout, except for commands that print a report there
+var logOutput io.Writer = os.Stdout
 
 func log(msg string, args ...interface{}) {
-	fmt.Printf("eximmon(v1.3.7):"+msg+"\n", args...)
+	fmt.Fprintf(logOutput, "eximmon(v1.3.7):"+msg+"\n", args...)
 }
 
 func debugLog(msg string, args ...interface{}) {
 	if debugMode {
-		fmt.Printf("eximmon(v1.3.7):"+msg+"\n", args...)
+		fmt.Fprintf(logOutput, "eximmon(v1.3.7):"+msg+"\n", args...)
 	}
 }
 
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"eximmon/exim"
+	"fmt"
+	"time"
+)
+
+// messages correlates arrivals with their deliveries, deferrals and bounces
+var messages = exim.NewTracker(24 * time.Hour)
+
+// outcome counter suffixes, stored next to the message counts
+const (
+	suffixDelivered = ".delivered"
+	suffixDeferred  = ".deferred"
+	suffixFailed    = ".failed"
+)
+
+// countOutcome counts the delivery result of an external recipient for the
+// sender of the message. Each kind of result counts once per recipient, so a
+// delivery after deferrals is counted as delivered too.
+func countOutcome(entry exim.LogEntry, msg *exim.Message, first bool, startTime time.Time, limits scanLimits) error {
+	if !first {
+		return nil
+	}
+
+	suffix := ""
+	switch entry.Flag {
+	case exim.FlagDelivery, exim.FlagCopy, exim.FlagCutthru:
+		suffix = suffixDelivered
+	case exim.FlagDeferred:
+		suffix = suffixDeferred
+	case exim.FlagFailed:
+		suffix = suffixFailed
+	default:
+		return nil
+	}
+
+	if !startTime.IsZero() && entry.Time.Before(startTime) {
+		return nil
+	}
+
+	sender, ok := outboundIdentity(msg.Arrival)
+	if !ok {
+		return nil
+	}
+
+	senderDomain, _ := sender.senderDomain(msg.Arrival)
+	if recipientDomain, err := emailDomainName(entry.Address); err == nil && recipientDomain == senderDomain {
+		return nil
+	}
+
+	if first, err := countOnce(entry.Time, msg.ID+" "+entry.Address+" "+suffix); err != nil || !first {
+		return err
+	}
+
+	minCount, hourCount, err := counterAdd(entry.Time, sender.Key(), suffix, 1)
+	if err != nil {
+		return err
+	}
+	debugLog("Outcome %s %s for %s: min=%d, hour=%d", entry.Flag, entry.Address, sender, minCount, hourCount)
+	if accountsEnabled(limits) {
+		if user := accounts.account(sender); user != "" {
+			if _, _, err := counterAdd(entry.Time, accountKey(user), suffix, 1); err != nil {
+				return err
+			}
+		}
+	}
+	if senderDomain != "" {
+		if _, _, err := counterAdd(entry.Time, domainKey(senderDomain), suffix, 1); err != nil {
+			return err
+		}
+	}
+
+	checkFailureRatio(sender, msg.ID+" "+entry.Address, entry.Time, suffix, limits)
+	return nil
+}
+
+// counterAdd adds n to the minute and hour counters of key
+func counterAdd(thetime time.Time, key string, suffix string, n int64) (int64, int64, error) {
+	minCount, hourCount, err := counterRead(thetime, key, suffix)
+	if err != nil {
+		return 0, 0, err
+	}
+	minCount += n
+	hourCount += n
+	if err := counterStore(thetime, key, suffix, hourCount, minCount); err != nil {
+		return 0, 0, err
+	}
+	return minCount, hourCount, nil
+}
+
+// printSenderStats shows hourly volume and delivery outcomes of a sender on a
+// day, and its quota usage up to the end of that day
+func printSenderStats(key string, day time.Time, limits scanLimits) error {
+	log("%s on %s", key, day.Format("2006-01-02"))
+	log("%-5s %8s %8s %10s %9s %7s", "hour", "sent", "rcpt", "delivered", "deferred", "failed")
+
+	for hour := 0; hour < 24; hour++ {
+		thetime := time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, day.Location())
+		row := make([]int64, 5)
+		for i, suffix := range statsSuffixes {
+			_, count, err := counterRead(thetime, key, suffix)
+			if err != nil {
+				return err
+			}
+			row[i] = count
+		}
+		if row[0] == 0 && row[2] == 0 && row[3] == 0 && row[4] == 0 {
+			continue
+		}
+		log("%-5s %8d %8d %10d %9d %7d", fmt.Sprintf("%02d", hour), row[0], row[1], row[2], row[3], row[4])
+	}
+
+	// the total includes the daily rollup of a pruned date, which has no hours left
+	totals, err := dayTotals(key, day)
+	if err != nil {
+		return err
+	}
+	log("%-5s %8d %8d %10d %9d %7d", "total", totals[0], totals[1], totals[2], totals[3], totals[4])
+
+	quota, err := quotaCount(time.Date(day.Year(), day.Month(), day.Day(), 23, 59, 59, 0, day.Location()), key)
+	if err != nil {
+		return err
+	}
+	log("quota: %s", quota.format(limits))
+	return nil
+}
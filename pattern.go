@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"eximmon/exim"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// logPatterns are the user defined patterns of the config file, tried in order
+var logPatterns []exim.Pattern
+
+// loadLogPatterns compiles the patterns section of the config
+func loadLogPatterns(cfg *AppConfig) ([]exim.Pattern, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	patterns := []exim.Pattern{}
+	for _, p := range cfg.PATTERNS {
+		pattern, err := exim.NewPattern(p.Name, p.Regex)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseTest shows how every line of path is parsed, - reads stdin
+func parseTest(path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	matched := map[string]int{}
+	skipped := 0
+	for lineNo := 1; ; lineNo++ {
+		text, err := reader.ReadString('\n')
+		text = strings.TrimRight(text, "\r\n")
+
+		if text != "" {
+			if name, ok := parseTestLine(lineNo, text); ok {
+				matched[name]++
+			} else {
+				skipped++
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	log("")
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log("matched %d by %s", matched[name], name)
+	}
+	log("skipped %d", skipped)
+	return nil
+}
+
+// parseTestLine prints the fields extracted from a line and which parser matched it
+func parseTestLine(lineNo int, text string) (string, bool) {
+	entry, name, err := exim.ParseLineWith(text, logPatterns)
+	if err != nil {
+		log("SKIP  %d: %v", lineNo, err)
+		return "", false
+	}
+	if name == "" {
+		if entry.MessageID == "" && entry.Cwd == "" {
+			log("SKIP  %d: no message id: %s", lineNo, text)
+			return "", false
+		}
+		name = "builtin"
+	}
+
+	fields := []string{"time=" + entry.Time.Format("2006-01-02 15:04:05 -0700")}
+	add := func(key string, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	add("pid", entry.PID)
+	add("id", entry.MessageID)
+	add("flag", entry.Flag)
+	add("address", entry.Address)
+	add("auth", entry.Auth)
+	add("user", entry.User)
+	add("protocol", entry.Protocol)
+	add("host", entry.Host)
+	add("recipients", strings.Join(entry.Recipients, ","))
+	add("error", entry.Error)
+	add("cwd", entry.Cwd)
+	add("script", entry.PHPScript)
+	if entry.Flag == exim.FlagArrival {
+		if sender, ok := outboundIdentity(entry); ok {
+			add("sender", sender.String())
+		} else {
+			add("sender", "-")
+		}
+	}
+
+	log("MATCH %d [%s]: %s", lineNo, name, strings.Join(fields, " "))
+	debugLog("      %s", text)
+	return name, true
+}
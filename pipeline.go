@@ -0,0 +1,135 @@
+package main
+
+import (
+	"eximmon/exim"
+	"sync"
+	"time"
+)
+
+// pipelineBuffer is the number of lines each stage may fall behind before
+// reading the log blocks
+const pipelineBuffer = 1024
+
+// scanLine is a log line on its way through the pipeline
+type scanLine struct {
+	text   string
+	lineNo int64
+	entry  exim.LogEntry
+	err    error
+}
+
+// scanPipeline parses and counts lines on their own goroutines, in log
+// order. Enforcement goes on to the action queue.
+type scanPipeline struct {
+	lines   chan scanLine
+	parsed  chan scanLine
+	pending sync.WaitGroup
+
+	// a following scan commits at most every commitInterval
+	follow     bool
+	committed  time.Time
+	cursorPath string
+	cursor     *logCursor // last flushed but not committed
+
+	mu  sync.Mutex
+	err error
+}
+
+// commitInterval is how often a following scan commits its counts and cursor,
+// the lines counted after the last commit are read again after a crash
+var commitInterval = 5 * time.Second
+
+func newScanPipeline(startTime time.Time, limits scanLimits, follow bool) *scanPipeline {
+	p := &scanPipeline{
+		lines:  make(chan scanLine, pipelineBuffer),
+		parsed: make(chan scanLine, pipelineBuffer),
+		follow: follow,
+	}
+	go p.parse()
+	go p.count(startTime, limits)
+	return p
+}
+
+func (p *scanPipeline) parse() {
+	for line := range p.lines {
+		line.entry, _, line.err = exim.ParseLineWith(line.text, logPatterns)
+		p.parsed <- line
+	}
+	close(p.parsed)
+}
+
+func (p *scanPipeline) count(startTime time.Time, limits scanLimits) {
+	for line := range p.parsed {
+		if line.err != nil {
+			debugLog("Not: %v | %v", line.err, line.text)
+		} else if p.failed() == nil {
+			debugLog("raw line %d: %v", line.lineNo, line.text)
+			if err := countEntry(line.entry, startTime, limits); err != nil {
+				p.mu.Lock()
+				p.err = err
+				p.mu.Unlock()
+			}
+		}
+		p.pending.Done()
+	}
+}
+
+func (p *scanPipeline) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// feed queues a line, blocking while the stages are behind
+func (p *scanPipeline) feed(text string, lineNo int64) error {
+	if err := p.failed(); err != nil {
+		return err
+	}
+	p.pending.Add(1)
+	p.lines <- scanLine{text: text, lineNo: lineNo}
+	return nil
+}
+
+// flush waits until every fed line is counted and commits the counts with
+// cursor. A following scan keeps the counter database open for a while.
+func (p *scanPipeline) flush(cursorPath string, cursor logCursor) error {
+	p.pending.Wait()
+	if err := p.failed(); err != nil {
+		return err
+	}
+	if !p.follow {
+		if err := commitCounters(cursorPath, cursor); err != nil {
+			return err
+		}
+		return releaseCounters()
+	}
+
+	if time.Since(p.committed) < commitInterval {
+		p.cursorPath, p.cursor = cursorPath, &cursor
+		return nil
+	}
+	if err := commitCounters(cursorPath, cursor); err != nil {
+		return err
+	}
+	p.committed, p.cursor = time.Now(), nil
+	releaseCountersLater()
+	return nil
+}
+
+// finish commits the last flush a following scan held back, once its source ended
+func (p *scanPipeline) finish() error {
+	if p.cursor == nil {
+		return nil
+	}
+	if err := commitCounters(p.cursorPath, *p.cursor); err != nil {
+		return err
+	}
+	p.cursor = nil
+	return releaseCounters()
+}
+
+// close stops the stages and waits for the fed lines to be done
+func (p *scanPipeline) close() {
+	close(p.lines)
+	p.pending.Wait()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// quotaCounts are the messages of a sender in the calendar day, week (from
+// Monday) and month, summed from the hour counters
+type quotaCounts struct {
+	Day   int64
+	Week  int64
+	Month int64
+}
+
+// quotaCount reads the quota usage of key up to thetime
+func quotaCount(thetime time.Time, key string) (quotaCounts, error) {
+	day := time.Date(thetime.Year(), thetime.Month(), thetime.Day(), 0, 0, 0, 0, thetime.Location())
+	week := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	month := day.AddDate(0, 0, 1-day.Day())
+
+	var q quotaCounts
+	var err error
+	if q.Day, err = counterSum(day, thetime, key, ""); err != nil {
+		return q, err
+	}
+	if q.Week, err = counterSum(week, thetime, key, ""); err != nil {
+		return q, err
+	}
+	if q.Month, err = counterSum(month, thetime, key, ""); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// quotasEnabled reports whether any quota is set, quotaCount is skipped otherwise
+func quotasEnabled(limits scanLimits) bool {
+	return limits.MaxPerDay > 0 || limits.MaxPerWeek > 0 || limits.MaxPerMonth > 0
+}
+
+// exceeded reports whether a quota is used up
+func (q quotaCounts) exceeded(limits scanLimits) bool {
+	return over(q.Day, limits.MaxPerDay) || over(q.Week, limits.MaxPerWeek) || over(q.Month, limits.MaxPerMonth)
+}
+
+// format shows the usage against each quota, e.g. day 120/500, week 800/off
+func (q quotaCounts) format(limits scanLimits) string {
+	parts := []string{}
+	for _, p := range []struct {
+		name  string
+		count int64
+		limit int64
+	}{{"day", q.Day, limits.MaxPerDay}, {"week", q.Week, limits.MaxPerWeek}, {"month", q.Month, limits.MaxPerMonth}} {
+		limit := "off"
+		if p.limit > 0 {
+			limit = fmt.Sprintf("%d", p.limit)
+		}
+		parts = append(parts, fmt.Sprintf("%s %d/%s", p.name, p.count, limit))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// rateEvent is a counted message and its external recipients, or the
+// messages of a stored minute counter
+type rateEvent struct {
+	at         time.Time
+	messages   int64
+	recipients int64
+}
+
+// rateTracker keeps the messages of each sender over sliding windows. The
+// calendar minute and hour counters are for reporting, a sender sending up to
+// the limit at 14:59 and again at 15:00 is only caught here.
+type rateTracker struct {
+	events map[string][]rateEvent
+	added  map[string]int // events of each key since the last commit
+	pruned time.Time
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{
+		events: map[string][]rateEvent{},
+		added:  map[string]int{},
+	}
+}
+
+var rates = newRateTracker()
+
+// rateCount is what a sender sent within a window ending at the last message
+type rateCount struct {
+	Messages   int64
+	Recipients int64
+}
+
+// add records a message and drops everything older than keep, the longest window
+func (t *rateTracker) add(key string, at time.Time, recipients int64, keep time.Duration) {
+	events := append(t.events[key], rateEvent{at: at, messages: 1, recipients: recipients})
+	t.added[key]++
+
+	// messages are logged in order, only the oldest can fall out
+	cutoff := at.Add(-keep)
+	start := 0
+	for start < len(events) && !events[start].at.After(cutoff) {
+		start++
+	}
+	t.events[key] = events[start:]
+
+	if at.Sub(t.pruned) >= keep {
+		t.prune(cutoff)
+		t.pruned = at
+	}
+}
+
+// prune forgets the senders without a message after cutoff
+func (t *rateTracker) prune(cutoff time.Time) {
+	for key, events := range t.events {
+		if len(events) == 0 || !events[len(events)-1].at.After(cutoff) {
+			delete(t.events, key)
+		}
+	}
+}
+
+// count returns the messages and recipients of key in the window ending at at
+func (t *rateTracker) count(key string, at time.Time, window time.Duration) rateCount {
+	cutoff := at.Add(-window)
+	count := rateCount{}
+	events := t.events[key]
+	for i := len(events) - 1; i >= 0 && events[i].at.After(cutoff); i-- {
+		if events[i].at.After(at) {
+			continue
+		}
+		count.Messages += events[i].messages
+		count.Recipients += events[i].recipients
+	}
+	return count
+}
+
+// commit keeps the messages added so far, they are counted with the counters
+func (t *rateTracker) commit() {
+	t.added = map[string]int{}
+}
+
+// rollback drops the messages added since the last commit, together with the
+// counters whose lines are read again. Pruning only drops the oldest
+// messages, so the ones added are the last of each key.
+func (t *rateTracker) rollback() {
+	for key, n := range t.added {
+		events := t.events[key]
+		if n > len(events) {
+			n = len(events)
+		}
+		if events = events[:len(events)-n]; len(events) == 0 {
+			delete(t.events, key)
+		} else {
+			t.events[key] = events
+		}
+	}
+	t.added = map[string]int{}
+}
+
+// seed fills the windows from the stored minute counters of the keep before
+// at, so a restart goes on from what was counted before it. The messages of a
+// minute are taken as sent at its start.
+func (t *rateTracker) seed(at time.Time, keep time.Duration) error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	db, err := openCounters()
+	if err != nil {
+		return err
+	}
+
+	from := at.Add(-keep)
+	first := time.Date(from.Year(), from.Month(), from.Day(), from.Hour(), from.Minute(), 0, 0, from.Location()).Add(time.Minute)
+	dates := map[string]bool{}
+	for minute := first; !minute.After(at); minute = minute.Add(time.Minute) {
+		dates[minute.Format("2006-01-02")] = true
+	}
+
+	owners := map[string]bool{}
+	for _, counters := range []map[counterID]int64{counterValues, counterUnsaved} {
+		for id := range counters {
+			if dates[id.date] {
+				owners[id.owner] = true
+			}
+		}
+	}
+
+	return db.View(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(owner []byte, ownerBucket *bolt.Bucket) error {
+			for date := range dates {
+				if ownerBucket.Bucket([]byte(date)) != nil {
+					owners[string(owner)] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for owner := range owners {
+			// scripts have no rate limits
+			if strings.HasPrefix(owner, scriptKey("")) {
+				continue
+			}
+			events := []rateEvent{}
+			for minute := first; !minute.After(at); minute = minute.Add(time.Minute) {
+				_, messagesID := counterNames(minute, owner, "")
+				_, recipientsID := counterNames(minute, owner, ".rcpt")
+				messages, err := storedCounter(tx, messagesID)
+				if err != nil {
+					return err
+				}
+				if messages == 0 {
+					continue
+				}
+				recipients, err := storedCounter(tx, recipientsID)
+				if err != nil {
+					return err
+				}
+				events = append(events, rateEvent{at: minute, messages: messages, recipients: recipients})
+			}
+			if len(events) > 0 {
+				t.events[owner] = events
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// countMessage counts a message in the counters and the windows, as countEntry does
+func countMessage(t *testing.T, key string, at time.Time, recipients int64) {
+	t.Helper()
+	if _, _, err := counterAdd(at, key, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := counterAdd(at, key, ".rcpt", recipients); err != nil {
+		t.Fatal(err)
+	}
+	rates.add(key, at, recipients, time.Hour)
+}
+
+func TestRateTrackerRestartAndRollback(t *testing.T) {
+	tempCounters(t)
+	oldRates := rates
+	t.Cleanup(func() { rates = oldRates })
+	rates = newRateTracker()
+	if err := recoverCounters(); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "a@example.com"
+	at := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	countMessage(t, key, at.Add(5*time.Minute), 1)
+	countMessage(t, key, at.Add(20*time.Minute), 2)
+	countMessage(t, key, at.Add(50*time.Minute+30*time.Second), 3)
+	countMessage(t, key, at.Add(50*time.Minute+40*time.Second), 4)
+	if _, _, err := counterAdd(at.Add(50*time.Minute), key, suffixDelivered, 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitCounters("", logCursor{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// read again from the stored cursor after a failed scan
+	countMessage(t, key, at.Add(55*time.Minute), 5)
+	if err := rollbackCounters(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rates.count(key, at.Add(70*time.Minute), time.Hour); got != (rateCount{Messages: 3, Recipients: 9}) {
+		t.Errorf("after rollback = %+v, want 3 messages 9 recipients", got)
+	}
+	countMessage(t, key, at.Add(55*time.Minute), 5)
+	if got := rates.count(key, at.Add(70*time.Minute), time.Hour); got != (rateCount{Messages: 4, Recipients: 14}) {
+		t.Errorf("counted again after rollback = %+v, want 4 messages 14 recipients", got)
+	}
+
+	// a crash before the commit, the uncommitted message is read again
+	if err := closeCounters(); err != nil {
+		t.Fatal(err)
+	}
+	counterValues = map[counterID]int64{}
+	counterPending = map[counterID]bool{}
+	counterUnsaved = map[counterID]int64{}
+	rates = newRateTracker()
+	if err := recoverCounters(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rates.seed(at.Add(70*time.Minute), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := rates.count(key, at.Add(70*time.Minute), time.Hour); got != (rateCount{Messages: 3, Recipients: 9}) {
+		t.Errorf("after restart = %+v, want 3 messages 9 recipients", got)
+	}
+	if got := rates.count(key, at.Add(50*time.Minute+59*time.Second), time.Minute); got != (rateCount{Messages: 2, Recipients: 7}) {
+		t.Errorf("minute after restart = %+v, want 2 messages 7 recipients", got)
+	}
+	countMessage(t, key, at.Add(71*time.Minute), 5)
+	if got := rates.count(key, at.Add(71*time.Minute), time.Hour); got != (rateCount{Messages: 4, Recipients: 14}) {
+		t.Errorf("counted after restart = %+v, want 4 messages 14 recipients", got)
+	}
+}
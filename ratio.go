@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// outcomeEvent is the final delivery result of an external recipient
+type outcomeEvent struct {
+	at      time.Time
+	failure bool // ** bounce, or == deferral without a later result within the window
+}
+
+// pendingDeferral is a deferred recipient waiting for its final result
+type pendingDeferral struct {
+	sender senderIdentity
+	at     time.Time
+}
+
+// failureTracker keeps the final delivery results of the recipients of each
+// sender over a rolling window. A deferral only counts as a failure once no
+// delivery or bounce of the recipient followed within the window, so
+// greylisting and retries do not count.
+type failureTracker struct {
+	events    map[string][]outcomeEvent
+	deferred  map[string]pendingDeferral // by message id and recipient
+	suspended map[string]time.Time
+	pruned    time.Time
+	settled   time.Time // deferrals were last checked for their window
+}
+
+var failures = newFailureTracker()
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{
+		events:    map[string][]outcomeEvent{},
+		deferred:  map[string]pendingDeferral{},
+		suspended: map[string]time.Time{},
+	}
+}
+
+// outcome records a delivery result of recipient, a message id and address,
+// and returns the senders whose results changed: the sender of a delivery or
+// bounce and those of deferrals still without a result after window
+func (t *failureTracker) outcome(sender senderIdentity, recipient string, at time.Time, suffix string, window time.Duration) []senderIdentity {
+	changed := []senderIdentity{}
+	if at.Sub(t.settled) >= time.Minute {
+		for key, d := range t.deferred {
+			if at.Sub(d.at) >= window {
+				delete(t.deferred, key)
+				t.add(d.sender.Key(), at, true, window)
+				changed = append(changed, d.sender)
+			}
+		}
+		t.settled = at
+	}
+
+	switch suffix {
+	case suffixDeferred:
+		if _, ok := t.deferred[recipient]; !ok {
+			t.deferred[recipient] = pendingDeferral{sender: sender, at: at}
+		}
+	case suffixDelivered, suffixFailed:
+		delete(t.deferred, recipient)
+		t.add(sender.Key(), at, suffix == suffixFailed, window)
+		changed = append(changed, sender)
+	}
+	return changed
+}
+
+// add records a final result and drops those older than window
+func (t *failureTracker) add(key string, at time.Time, failure bool, window time.Duration) {
+	events := append(t.events[key], outcomeEvent{at: at, failure: failure})
+
+	// results are logged in order, drop everything older than the window
+	cutoff := at.Add(-window)
+	start := 0
+	for start < len(events) && events[start].at.Before(cutoff) {
+		start++
+	}
+	t.events[key] = events[start:]
+
+	if at.Sub(t.pruned) >= window {
+		t.prune(cutoff)
+		t.pruned = at
+	}
+}
+
+// prune forgets the senders without a result or a suspension since cutoff
+func (t *failureTracker) prune(cutoff time.Time) {
+	for key, events := range t.events {
+		if len(events) == 0 || events[len(events)-1].at.Before(cutoff) {
+			delete(t.events, key)
+		}
+	}
+	for key, last := range t.suspended {
+		if !last.After(cutoff) {
+			delete(t.suspended, key)
+		}
+	}
+}
+
+// count returns the failures and total results of key, as of its last add
+func (t *failureTracker) count(key string) (int64, int64) {
+	failed := int64(0)
+	for _, e := range t.events[key] {
+		if e.failure {
+			failed++
+		}
+	}
+	return failed, int64(len(t.events[key]))
+}
+
+// checkFailureRatio records a delivery result of recipient and suspends the
+// senders whose bounced and still deferred recipients exceed the configured
+// ratio, once enough recipients have a result in the window
+func checkFailureRatio(sender senderIdentity, recipient string, at time.Time, suffix string, limits scanLimits) {
+	if limits.MaxFailureRatio <= 0 {
+		return
+	}
+
+	for _, changed := range failures.outcome(sender, recipient, at, suffix, limits.FailureWindow) {
+		key := changed.Key()
+		failed, total := failures.count(key)
+		if total < limits.FailureMinSample {
+			continue
+		}
+
+		ratio := float64(failed) / float64(total)
+		if ratio <= limits.MaxFailureRatio {
+			continue
+		}
+
+		if last, ok := failures.suspended[key]; ok && at.Sub(last) < limits.FailureWindow {
+			continue
+		}
+		failures.suspended[key] = at
+
+		log("Failure ratio of %s is %.2f (%d of %d in %s)", changed, ratio, failed, total, limits.FailureWindow)
+		suspendSender(changed, fmt.Sprintf("Bounced or still deferred after %s: %d of %d recipients (%.0f%%) in %s",
+			limits.FailureWindow, failed, total, ratio*100, limits.FailureWindow))
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureTrackerFinalOutcome(t *testing.T) {
+	tracker := newFailureTracker()
+	sender := senderIdentity{Email: "a@example.com"}
+	window := time.Hour
+	at := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+
+	// greylisted, then delivered on the retry: one delivered recipient
+	if changed := tracker.outcome(sender, "m1 r@example.org", at, suffixDeferred, window); len(changed) != 0 {
+		t.Errorf("a deferral changed %v", changed)
+	}
+	tracker.outcome(sender, "m1 r@example.org", at.Add(5*time.Minute), suffixDeferred, window)
+	changed := tracker.outcome(sender, "m1 r@example.org", at.Add(10*time.Minute), suffixDelivered, window)
+	if len(changed) != 1 || changed[0] != sender {
+		t.Errorf("delivery changed %v", changed)
+	}
+	if failed, total := tracker.count(sender.Key()); failed != 0 || total != 1 {
+		t.Errorf("after deferral and delivery failed=%d total=%d, want 0 1", failed, total)
+	}
+
+	// deferred on every retry: one failure once the window is over
+	for i := 0; i < 5; i++ {
+		tracker.outcome(sender, "m2 s@example.net", at.Add(time.Duration(15+i)*time.Minute), suffixDeferred, window)
+	}
+	if failed, total := tracker.count(sender.Key()); failed != 0 || total != 1 {
+		t.Errorf("pending deferrals counted: failed=%d total=%d", failed, total)
+	}
+	tracker.outcome(sender, "m3 t@example.com", at.Add(80*time.Minute), suffixFailed, window)
+	if failed, total := tracker.count(sender.Key()); failed != 2 || total != 2 {
+		t.Errorf("after the window failed=%d total=%d, want the deferral and the bounce 2 2", failed, total)
+	}
+	if len(tracker.deferred) != 0 {
+		t.Errorf("deferrals left: %v", tracker.deferred)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"eximmon/bot"
+	"eximmon/exim"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// rejectLog is read for failed SMTP logins, "off" disables it
+var rejectLog = "/var/log/exim_rejectlog"
+
+// rejectCursorPath is the last scanned position of the reject log
+var rejectCursorPath = ".rejectconfig"
+
+// authBlockCmd blocks an attacking IP, {ip} is replaced with the address,
+// e.g. csf -d {ip} eximmon brute force
+var authBlockCmd = ""
+
+// authFailureTracker keeps failed logins per client IP and per mailbox over a rolling window
+type authFailureTracker struct {
+	attempts map[string][]time.Time
+	alerted  map[string]time.Time
+	pruned   time.Time
+}
+
+var authFailures = &authFailureTracker{
+	attempts: map[string][]time.Time{},
+	alerted:  map[string]time.Time{},
+}
+
+// add records a failed login and returns the failures of key within window
+func (t *authFailureTracker) add(key string, at time.Time, window time.Duration) int64 {
+	attempts := append(t.attempts[key], at)
+
+	cutoff := at.Add(-window)
+	start := 0
+	for start < len(attempts) && attempts[start].Before(cutoff) {
+		start++
+	}
+	attempts = attempts[start:]
+	t.attempts[key] = attempts
+
+	if at.Sub(t.pruned) >= window {
+		t.prune(cutoff)
+		t.pruned = at
+	}
+	return int64(len(attempts))
+}
+
+// prune forgets the IPs and mailboxes without a failure or an alert since cutoff
+func (t *authFailureTracker) prune(cutoff time.Time) {
+	for key, attempts := range t.attempts {
+		if len(attempts) == 0 || attempts[len(attempts)-1].Before(cutoff) {
+			delete(t.attempts, key)
+		}
+	}
+	for key, last := range t.alerted {
+		if !last.After(cutoff) {
+			delete(t.alerted, key)
+		}
+	}
+}
+
+// alert reports whether key was not alerted on within window, and marks it alerted
+func (t *authFailureTracker) alert(key string, at time.Time, window time.Duration) bool {
+	if last, ok := t.alerted[key]; ok && at.Sub(last) < window {
+		return false
+	}
+	t.alerted[key] = at
+	return true
+}
+
+// scanRejectLog reads the reject log from the stored position. When follow is
+// set it keeps waiting for new lines.
+func scanRejectLog(path string, limits scanLimits, follow bool) error {
+	cursor, err := loadCursor(rejectCursorPath, path)
+	if err != nil {
+		return err
+	}
+
+	follower, err := openLogFollower(path)
+	if os.IsNotExist(err) {
+		debugLog("Reject log %s not found", path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer follower.Close()
+
+	handle := func(text string, lineNo int64) error {
+		countAuthFailure(text, limits)
+		return nil
+	}
+
+	prefix := ""
+	if cursor.Offset > 0 {
+		if cursor.Device == follower.device && cursor.Inode == follower.inode {
+			resumed, err := follower.Resume(cursor)
+			if err != nil {
+				return err
+			}
+			if resumed {
+				prefix = cursor.Prefix
+			}
+		} else if err := scanRotatedRejectLog(path, cursor, handle); err != nil {
+			return err
+		}
+	}
+
+	return scanSource(follower, rejectCursorPath, prefix, follow, handle, nil)
+}
+
+// scanRotatedRejectLog finishes the reject log the cursor points to after
+// logrotate renamed it, as scanRotatedLog does for the main log
+func scanRotatedRejectLog(path string, cursor logCursor, handle func(text string, lineNo int64) error) error {
+	rotatedLog, err := findRotatedLog(path, cursor)
+	if err != nil {
+		return err
+	}
+	if rotatedLog == "" {
+		log("Rotated log for last position not found, starting %s from the beginning", path)
+		return nil
+	}
+
+	log("Finishing rotated log %s from offset %d", rotatedLog, cursor.Offset)
+	follower, err := openLogFollower(rotatedLog)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+
+	resumed, err := follower.Resume(cursor)
+	if err != nil {
+		return err
+	}
+	if !resumed {
+		log("Rotated log %s does not match last position, skipping", rotatedLog)
+		return nil
+	}
+
+	return scanSource(follower, rejectCursorPath, cursor.Prefix, false, handle, nil)
+}
+
+// countAuthFailure tracks a 535 rejection, alerting once an IP or a mailbox
+// goes over its limit and blocking the IP when authBlockCmd is set
+func countAuthFailure(text string, limits scanLimits) {
+	failure, ok, err := exim.ParseAuthFailure(text)
+	if err != nil {
+		debugLog("Unable to parse reject line: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	//attacks that are already over are not acted on, e.g. on the first scan
+	if time.Since(failure.Time) > limits.AuthFailWindow {
+		return
+	}
+
+	window := limits.AuthFailWindow
+	ipCount := authFailures.add("ip:"+failure.IP, failure.Time, window)
+	debugLog("Failed login from %s for %s: %d in %s", failure.IP, failure.SetID, ipCount, window)
+	if over(ipCount, limits.MaxAuthFailPerIP) && authFailures.alert("ip:"+failure.IP, failure.Time, window) {
+		actions.submit("ip:"+failure.IP, func() {
+			blocked := blockIP(failure.IP)
+			log("Brute force from %s: %d failed logins in %s, blocked=%v", failure.IP, ipCount, window, blocked)
+			if err := botEngine.NotifyAuthAttack(bot.AuthAttackInfo{IP: failure.IP, Failures: int(ipCount), Window: window, Blocked: blocked}); err != nil {
+				log("NotifyAuthAttack error: %+v", err)
+			}
+		})
+	}
+
+	if failure.SetID == "" {
+		return
+	}
+	mailboxCount := authFailures.add("mailbox:"+failure.SetID, failure.Time, window)
+	if over(mailboxCount, limits.MaxAuthFailPerMailbox) && authFailures.alert("mailbox:"+failure.SetID, failure.Time, window) {
+		log("Brute force on %s: %d failed logins in %s", failure.SetID, mailboxCount, window)
+		actions.submit("mailbox:"+failure.SetID, func() {
+			if err := botEngine.NotifyAuthAttack(bot.AuthAttackInfo{Mailbox: failure.SetID, Failures: int(mailboxCount), Window: window}); err != nil {
+				log("NotifyAuthAttack error: %+v", err)
+			}
+		})
+	}
+}
+
+// blockIP runs authBlockCmd for ip, loopback clients such as webmail are never blocked
+func blockIP(ip string) bool {
+	if authBlockCmd == "" {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsLoopback() {
+		return false
+	}
+
+	command := strings.ReplaceAll(authBlockCmd, "{ip}", parsed.String())
+	out, err := exec.Command("sh", "-c", command).CombinedOutput()
+	if err != nil {
+		log("Unable to block %s: %v %s", ip, err, out)
+		return false
+	}
+	log("Blocked %s: %s", ip, command)
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"eximmon/exim"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanRejectLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldCursorPath, oldFailures := rejectCursorPath, authFailures
+	rejectCursorPath = filepath.Join(dir, ".rejectconfig")
+	authFailures = &authFailureTracker{attempts: map[string][]time.Time{}, alerted: map[string]time.Time{}}
+	t.Cleanup(func() { rejectCursorPath, authFailures = oldCursorPath, oldFailures })
+
+	limits := scanLimits{AuthFailWindow: time.Hour}
+	line := time.Now().In(exim.Location).Format("2006-01-02 15:04:05") +
+		" dovecot_login authenticator failed for (User) [203.0.113.5]:51234: 535 Incorrect authentication data (set_id=info@example.com)\n"
+	appendLines := func(path string, n int) {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		for i := 0; i < n; i++ {
+			if _, err := file.WriteString(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scan := func(want int) {
+		t.Helper()
+		if err := scanRejectLog(filepath.Join(dir, "exim_rejectlog"), limits, false); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(authFailures.attempts["ip:203.0.113.5"]); got != want {
+			t.Errorf("failed logins = %d, want %d", got, want)
+		}
+	}
+
+	path := filepath.Join(dir, "exim_rejectlog")
+	appendLines(path, 2)
+	scan(2)
+
+	// written after the last scan, then rotated away before the next one
+	appendLines(path, 1)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(path, 1)
+	scan(4)
+	scan(4)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"eximmon/exim"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// cpanelHome holds the cPanel accounts, the mailboxes of a domain are listed
+// in <home>/<user>/etc/<domain>/passwd
+var cpanelHome = "/home"
+
+// knownSenders returns the sender keys of the mailboxes of every cPanel
+// domain and of every sender and script in logFile and its rotated copies
+func knownSenders(logFile string) (map[string]bool, error) {
+	senders := map[string]bool{}
+
+	for domain, user := range loadUserDomains(userDomainsPath) {
+		senders["user:"+user] = true
+		file, err := os.Open(filepath.Join(cpanelHome, user, "etc", domain, "passwd"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if local := strings.SplitN(scanner.Text(), ":", 2)[0]; local != "" {
+				senders[local+"@"+domain] = true
+			}
+		}
+		file.Close()
+	}
+
+	archives, err := logArchives(logFile, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range append(archives, logFile) {
+		log("Reading senders of %s", path)
+		tracker := &scriptTracker{byPID: map[string]string{}}
+		err := readLogArchive(path, func(text string, lineNo int64) error {
+			entry, _, err := exim.ParseLineWith(text, logPatterns)
+			if err != nil {
+				return nil
+			}
+			if entry.Cwd != "" {
+				tracker.seen(entry)
+				return nil
+			}
+			sender, ok := outboundIdentity(entry)
+			if !ok {
+				return nil
+			}
+			senders[sender.Key()] = true
+			if sender.User != "" && strings.HasPrefix(entry.Protocol, "local") {
+				if script, _ := tracker.attach(entry); script != "" {
+					senders[scriptKey(script)] = true
+				}
+			}
+			return nil
+		})
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return senders, nil
+}
+
+// rekeyCounters moves the buckets of earlier versions, named by cleanPath
+// with 2006_01_02 dates, to the sender they belong to. A name is resolved
+// when assigned, when exactly one known sender cleans to it ignoring case,
+// when it is a script still found at its path, or when cleanPath did not
+// change it. The others are reported and left as they are.
+func rekeyCounters(senders map[string]bool, assigned map[string]string) error {
+	candidates := map[string][]string{}
+	for sender := range senders {
+		name := strings.ToLower(cleanPath(sender))
+		candidates[name] = append(candidates[name], sender)
+	}
+
+	moved, ambiguous := 0, 0
+	err := counterBatch(func(tx *bolt.Tx) error {
+		legacy := map[string][][]byte{}
+		err := tx.ForEach(func(owner []byte, ownerBucket *bolt.Bucket) error {
+			return ownerBucket.ForEachBucket(func(date []byte) error {
+				if _, err := time.Parse("2006_01_02", string(date)); err == nil {
+					legacy[string(owner)] = append(legacy[string(owner)], append([]byte{}, date...))
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		owners := make([]string, 0, len(legacy))
+		for owner := range legacy {
+			owners = append(owners, owner)
+		}
+		sort.Strings(owners)
+
+		for _, owner := range owners {
+			target, ok := assigned[owner]
+			found := candidates[strings.ToLower(owner)]
+			script, isScript := legacyScript(owner)
+			switch {
+			case ok:
+			case owner == countedBucket:
+				target = owner
+			case len(found) == 1:
+				target = found[0]
+			case len(found) == 0 && isScript:
+				target = scriptKey(script)
+			case len(found) == 0 && !strings.Contains(owner, "_"):
+				target = owner
+			default:
+				ambiguous++
+				sort.Strings(found)
+				log("Ambiguous %s (%d dates): candidates [%s], assign it with: eximmon rekey '%s=<sender>'",
+					owner, len(legacy[owner]), strings.Join(found, ", "), owner)
+				continue
+			}
+
+			debugLog("Moving %s to %s", owner, target)
+			if err := moveLegacyDates(tx, owner, target, legacy[owner]); err != nil {
+				return fmt.Errorf("Unable to move %s to %s: %v", owner, target, err)
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log("Re-keyed %d senders, %d ambiguous left as they are", moved, ambiguous)
+	return nil
+}
+
+// legacyScript returns the path of a script bucket of earlier versions, named
+// by cleanPath of its scriptKey, when the path has no - or @ that cleanPath
+// may have replaced, or when the script is still there
+func legacyScript(owner string) (string, bool) {
+	if !strings.HasPrefix(owner, scriptKey("")) {
+		return "", false
+	}
+	path, err := url.PathUnescape(strings.TrimPrefix(owner, scriptKey("")))
+	if err != nil || !filepath.IsAbs(path) {
+		return "", false
+	}
+	if !strings.Contains(path, "_") {
+		return path, true
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, true
+	}
+	return "", false
+}
+
+// rekeyedBucket records the legacy owner/date buckets already moved, with
+// the sender they went to
+const rekeyedBucket = "rekeyed-dates"
+
+// moveLegacyDates adds the counters of the legacy date buckets of owner to
+// those of target, then removes them and owner once it is empty. A date
+// moved before, imported again from data/, is removed without adding it twice.
+func moveLegacyDates(tx *bolt.Tx, owner string, target string, dates [][]byte) error {
+	rekeyed, err := tx.CreateBucketIfNotExists([]byte(rekeyedBucket))
+	if err != nil {
+		return err
+	}
+
+	ownerBucket := tx.Bucket([]byte(owner))
+	for _, date := range dates {
+		day, _ := time.Parse("2006_01_02", string(date))
+		moved := []byte(owner + "/" + string(date))
+		if to := rekeyed.Get(moved); to != nil {
+			log("Skipping %s/%s: already moved to %s", owner, date, to)
+			if err := ownerBucket.DeleteBucket(date); err != nil {
+				return err
+			}
+			continue
+		}
+
+		type counter struct {
+			key   []byte
+			count int64
+		}
+		counters := []counter{}
+		err := ownerBucket.Bucket(date).ForEach(func(k []byte, v []byte) error {
+			count, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("counter %s/%s/%s: %v", owner, date, k, err)
+			}
+			counters = append(counters, counter{append([]byte{}, k...), count})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, c := range counters {
+			id := counterID{target, day.Format("2006-01-02"), string(c.key)}
+			existing, err := counterGet(tx, id)
+			if err != nil {
+				return err
+			}
+			if err := counterPut(tx, id, existing+c.count); err != nil {
+				return err
+			}
+		}
+		if err := rekeyed.Put(moved, []byte(target)); err != nil {
+			return err
+		}
+		if err := ownerBucket.DeleteBucket(date); err != nil {
+			return err
+		}
+	}
+
+	if k, _ := ownerBucket.Cursor().First(); k == nil {
+		return tx.DeleteBucket([]byte(owner))
+	}
+	return nil
+}
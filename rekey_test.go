@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// putLegacy writes a counter the way earlier versions named it
+func putLegacy(t *testing.T, owner string, date string, key string, value string) {
+	t.Helper()
+	err := counterBatch(func(tx *bolt.Tx) error {
+		ownerBucket, err := tx.CreateBucketIfNotExists([]byte(owner))
+		if err != nil {
+			return err
+		}
+		dateBucket, err := ownerBucket.CreateBucketIfNotExists([]byte(date))
+		if err != nil {
+			return err
+		}
+		return dateBucket.Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hasBucket reports whether the database holds the bucket owner
+func hasBucket(t *testing.T, owner string) bool {
+	t.Helper()
+	db, err := counters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(owner)) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestRekeyCounters(t *testing.T) {
+	tempCounters(t)
+
+	putLegacy(t, "john_doe_example.com", "2024_03_05", "10", "3")
+	putLegacy(t, "a_b_example.com", "2024_03_05", "10", "4")
+	putLegacy(t, "plain", "2024_03_05", "10", "6")
+	if err := counterBatch(func(tx *bolt.Tx) error {
+		return counterPut(tx, counterID{"john-doe@example.com", "2024-03-05", "10"}, 2)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	senders := map[string]bool{
+		"john-doe@example.com": true,
+		"a-b@example.com":      true,
+		"a_b@example.com":      true,
+	}
+	if err := rekeyCounters(senders, nil); err != nil {
+		t.Fatalf("rekeyCounters: %v", err)
+	}
+
+	if got := savedCounter(t, counterID{"john-doe@example.com", "2024-03-05", "10"}); got != 5 {
+		t.Errorf("john-doe@example.com = %d, want 2+3", got)
+	}
+	if got := savedCounter(t, counterID{"plain", "2024-03-05", "10"}); got != 6 {
+		t.Errorf("plain = %d, want 6", got)
+	}
+	if hasBucket(t, "john_doe_example.com") || savedCounter(t, counterID{"plain", "2024_03_05", "10"}) != 0 {
+		t.Errorf("moved legacy buckets are left")
+	}
+	if got := savedCounter(t, counterID{"a_b_example.com", "2024_03_05", "10"}); got != 4 {
+		t.Errorf("ambiguous a_b_example.com = %d, want it left as 4", got)
+	}
+
+	// assigning the ambiguous one moves it
+	if err := rekeyCounters(senders, map[string]string{"a_b_example.com": "a_b@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := savedCounter(t, counterID{"a_b@example.com", "2024-03-05", "10"}); got != 4 {
+		t.Errorf("a_b@example.com = %d, want 4", got)
+	}
+	if hasBucket(t, "a_b_example.com") {
+		t.Errorf("assigned legacy bucket is left")
+	}
+}
+
+func TestRekeyCountersTwice(t *testing.T) {
+	tempCounters(t)
+	senders := map[string]bool{"john-doe@example.com": true}
+
+	// the same legacy date imported again is dropped, not added twice
+	for i := 0; i < 2; i++ {
+		putLegacy(t, "john_doe_example.com", "2024_03_05", "10", "5")
+		if err := rekeyCounters(senders, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := savedCounter(t, counterID{"john-doe@example.com", "2024-03-05", "10"}); got != 5 {
+			t.Errorf("run %d: john-doe@example.com = %d, want 5", i+1, got)
+		}
+		if hasBucket(t, "john_doe_example.com") {
+			t.Errorf("run %d: legacy bucket is left", i+1)
+		}
+	}
+}
+
+func TestMigrateDataTreeTwice(t *testing.T) {
+	dir := tempCounters(t)
+	data := filepath.Join(dir, "data")
+	dateDir := filepath.Join(data, "john_doe_example.com", "2024_03_05")
+	if err := os.MkdirAll(dateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dateDir, "10"), []byte("5"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	senders := map[string]bool{"john-doe@example.com": true}
+
+	for i := 0; i < 2; i++ {
+		if err := migrateDataTree(data + "/"); err != nil {
+			t.Fatalf("run %d: migrateDataTree: %v", i+1, err)
+		}
+		if err := rekeyCounters(senders, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := savedCounter(t, counterID{"john-doe@example.com", "2024-03-05", "10"}); got != 5 {
+			t.Errorf("run %d: john-doe@example.com = %d, want 5", i+1, got)
+		}
+	}
+
+	if _, err := os.Stat(data); !os.IsNotExist(err) {
+		t.Errorf("%s is still there: %v", data, err)
+	}
+	if _, err := os.Stat(data + ".migrated"); err != nil {
+		t.Errorf("%s.migrated: %v", data, err)
+	}
+}
+
+func TestRekeyCountersCaseAndScripts(t *testing.T) {
+	dir := tempCounters(t)
+	present := filepath.Join(dir, "public_html", "mailer.php")
+	if err := os.MkdirAll(filepath.Dir(present), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(present, []byte("<?php"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logged := "/home/u/public_html/send-mail.php"
+	gone := "/home/u/public_html/old.php"
+
+	putLegacy(t, "John_Doe_Example.com", "2024_03_05", "10", "3")
+	putLegacy(t, cleanPath(scriptKey("/srv/mailer.php")), "2024_03_05", "10", "4")
+	putLegacy(t, cleanPath(scriptKey(present)), "2024_03_05", "10", "5")
+	putLegacy(t, cleanPath(scriptKey(logged)), "2024_03_05", "10", "6")
+	putLegacy(t, cleanPath(scriptKey(gone)), "2024_03_05", "10", "7")
+
+	senders := map[string]bool{
+		"john-doe@example.com": true,
+		scriptKey(logged):      true,
+	}
+	if err := rekeyCounters(senders, nil); err != nil {
+		t.Fatalf("rekeyCounters: %v", err)
+	}
+
+	for owner, want := range map[string]int64{
+		"john-doe@example.com":       3,
+		scriptKey("/srv/mailer.php"): 4,
+		scriptKey(present):           5,
+		scriptKey(logged):            6,
+	} {
+		if got := savedCounter(t, counterID{owner, "2024-03-05", "10"}); got != want {
+			t.Errorf("%s = %d, want %d", owner, got, want)
+		}
+	}
+	if got := savedCounter(t, counterID{cleanPath(scriptKey(gone)), "2024_03_05", "10"}); got != 7 {
+		t.Errorf("script not found anywhere = %d, want it left as 7", got)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// retention is how many days counters are kept, zero keeps them forever
+type retention struct {
+	MinuteDays int64 // older dates keep only their hour counters
+	HourDays   int64 // older dates keep a daily rollup
+	Days       int64 // older dates are deleted
+}
+
+var counterRetention = retention{MinuteDays: 7, HourDays: 90, Days: 365}
+
+// pruneCounters rolls up and deletes the counters past their retention, as of now
+func pruneCounters(now time.Time, keep retention) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	expired := func(date time.Time, days int64) bool {
+		return days > 0 && date.Before(today.AddDate(0, 0, -int(days)))
+	}
+
+	hourly, daily, deleted := 0, 0, 0
+	err := counterBatch(func(tx *bolt.Tx) error {
+		owners := [][]byte{}
+		err := tx.ForEach(func(owner []byte, ownerBucket *bolt.Bucket) error {
+			dates := [][]byte{}
+			if err := ownerBucket.ForEachBucket(func(date []byte) error {
+				dates = append(dates, date)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for _, date := range dates {
+				datetime, err := time.ParseInLocation("2006-01-02", string(date), now.Location())
+				if err != nil {
+					debugLog("Skipping %s/%s: not a date", owner, date)
+					continue
+				}
+
+				switch {
+				case string(owner) == countedBucket:
+					//message ids go with the counters of their date
+					if expired(datetime, keep.Days) {
+						if err := ownerBucket.DeleteBucket(date); err != nil {
+							return err
+						}
+					}
+				case expired(datetime, keep.Days):
+					debugLog("removing: %s/%s", owner, date)
+					if err := ownerBucket.DeleteBucket(date); err != nil {
+						return err
+					}
+					deleted++
+				case expired(datetime, keep.HourDays):
+					if changed, err := rollupDate(ownerBucket.Bucket(date), true); err != nil {
+						return fmt.Errorf("Unable to roll up %s/%s: %v", owner, date, err)
+					} else if changed {
+						daily++
+					}
+				case expired(datetime, keep.MinuteDays):
+					if changed, err := rollupDate(ownerBucket.Bucket(date), false); err != nil {
+						return fmt.Errorf("Unable to roll up %s/%s: %v", owner, date, err)
+					} else if changed {
+						hourly++
+					}
+				}
+			}
+
+			if k, _ := ownerBucket.Cursor().First(); k == nil {
+				owners = append(owners, owner)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, owner := range owners {
+			if err := tx.DeleteBucket(owner); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log("Pruned counters: %d dates rolled up to hours, %d to a day, %d deleted", hourly, daily, deleted)
+	return nil
+}
+
+// rollupDate drops the minute counters of a date bucket, filling in any
+// missing hour counter from them. With daily the hour counters are summed
+// into the dayKey counters too. It reports whether anything was dropped.
+func rollupDate(dateBucket *bolt.Bucket, daily bool) (bool, error) {
+	hours := map[string]int64{}   // "15.rcpt" -> hour counter
+	minutes := map[string]int64{} // "15.rcpt" -> sum of its minute counters
+	days := map[string]int64{}    // ".rcpt" -> daily rollup
+	remove := [][]byte{}
+
+	err := dateBucket.ForEach(func(k []byte, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		count, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("counter %s: %v", k, err)
+		}
+
+		name := string(k)
+		switch digits := len(name) - len(strings.TrimLeft(name, "0123456789")); {
+		case strings.HasPrefix(name, dayKey):
+			days[name[len(dayKey):]] += count
+			return nil
+		case digits == 2:
+			hours[name] = count
+			if !daily {
+				return nil
+			}
+		case digits == 4:
+			minutes[name[:2]+name[4:]] += count
+		default:
+			return nil
+		}
+		remove = append(remove, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil || len(remove) == 0 {
+		return false, err
+	}
+
+	for hour, count := range minutes {
+		if _, ok := hours[hour]; !ok {
+			hours[hour] = count
+			if !daily {
+				if err := dateBucket.Put([]byte(hour), []byte(strconv.FormatInt(count, 10))); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+	if daily {
+		for hour, count := range hours {
+			days[hour[2:]] += count
+		}
+		for suffix, count := range days {
+			if err := dateBucket.Put([]byte(dayKey+suffix), []byte(strconv.FormatInt(count, 10))); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for _, k := range remove {
+		if err := dateBucket.Delete(k); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
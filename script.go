@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"eximmon/exim"
+	"eximmon/tools"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var containedPath = ".contained"
+
+// containScripts disables a script's permissions when its sender gets suspended
+var containScripts = false
+
+// scriptTracker remembers cwd= lines until the arrival of the message they belong to
+type scriptTracker struct {
+	byPID   map[string]string
+	lastCwd string
+}
+
+var scripts = &scriptTracker{byPID: map[string]string{}}
+
+// containedScript is what is needed to undo a containment
+type containedScript struct {
+	Mode        os.FileMode `json:"mode"`
+	ContainedAt time.Time   `json:"contained_at"`
+	Sender      string      `json:"sender"`
+}
+
+// seen records the working directory of a local submission
+func (t *scriptTracker) seen(entry exim.LogEntry) {
+	cwd := filepath.Clean(entry.Cwd)
+	if cwd == "/" || strings.HasPrefix(cwd, "/var/spool/exim") {
+		// exim itself, queue runners and deliveries
+		return
+	}
+
+	if entry.PID != "" {
+		if len(t.byPID) > 1000 {
+			t.byPID = map[string]string{}
+		}
+		t.byPID[entry.PID] = cwd
+	}
+	t.lastCwd = cwd
+}
+
+// attach returns the originating script of a local submission, or the
+// directory it was sent from when the script itself is not logged. exact is
+// true when the path is known to be the script, so it may be contained: an
+// absolute path logged by PHP, or a relative name under the cwd= of the same
+// PID. A name joined with the cwd of another submission is only reported.
+func (t *scriptTracker) attach(entry exim.LogEntry) (path string, exact bool) {
+	cwd := ""
+	pidMatch := false
+	if entry.PID != "" {
+		cwd = t.byPID[entry.PID]
+		delete(t.byPID, entry.PID)
+		pidMatch = cwd != ""
+	}
+	if cwd == "" {
+		cwd = t.lastCwd
+	}
+	t.lastCwd = ""
+
+	script := ""
+	if i := strings.Index(entry.OriginatingScript, ":"); i >= 0 {
+		// uid:script.php, or uid:/home/user/public_html/script.php
+		script = entry.OriginatingScript[i+1:]
+	} else if entry.PHPScript != "" {
+		// domain/path/script.php, the path is the URL, not where the file is
+		script = filepath.Base(entry.PHPScript)
+	}
+
+	switch {
+	case script == "":
+		return cwd, false
+	case filepath.IsAbs(script):
+		return filepath.Clean(script), true
+	case cwd == "":
+		return "", false
+	}
+	return filepath.Join(cwd, script), pidMatch
+}
+
+// scriptKey is the name counters of a script are stored under
+func scriptKey(path string) string {
+	return "script:" + url.PathEscape(path)
+}
+
+func loadContained() (map[string]containedScript, error) {
+	contained := map[string]containedScript{}
+	content, err := os.ReadFile(containedPath)
+	if os.IsNotExist(err) {
+		return contained, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &contained); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", containedPath, err)
+	}
+	return contained, nil
+}
+
+// lockContained holds containedPath while it is read and rewritten, as
+// eximmon contain and uncontain change it while the scanner does. The lock is
+// on a file of its own as storeContained replaces containedPath.
+func lockContained() (*os.File, error) {
+	file, err := os.OpenFile(containedPath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitLockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to lock %s: %v", containedPath, err)
+	}
+	return file, nil
+}
+
+func storeContained(contained map[string]containedScript) error {
+	data, err := json.MarshalIndent(contained, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tools.WriteFileAtomic(containedPath, data, 0600)
+}
+
+// containScript removes all permissions of a script so it can no longer be
+// executed or read by the web server, keeping the old mode for uncontainScript
+func containScript(path string, sender string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", path)
+	}
+
+	lock, err := lockContained()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	contained, err := loadContained()
+	if err != nil {
+		return err
+	}
+	if _, ok := contained[path]; ok {
+		return nil
+	}
+
+	// the old mode is saved first, a script left at 0 without it could not be restored
+	contained[path] = containedScript{Mode: fi.Mode().Perm(), ContainedAt: time.Now(), Sender: sender}
+	if err := storeContained(contained); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0); err != nil {
+		delete(contained, path)
+		if storeErr := storeContained(contained); storeErr != nil {
+			log("Unable to remove %s from %s: %+v", path, containedPath, storeErr)
+		}
+		return err
+	}
+	log("Contained script %s (was %s)", path, fi.Mode().Perm())
+	return nil
+}
+
+// uncontainScript restores the permissions saved by containScript
+func uncontainScript(path string) error {
+	lock, err := lockContained()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	contained, err := loadContained()
+	if err != nil {
+		return err
+	}
+	info, ok := contained[path]
+	if !ok {
+		return fmt.Errorf("%s is not contained", path)
+	}
+
+	if err := os.Chmod(path, info.Mode); err != nil {
+		return err
+	}
+	delete(contained, path)
+	log("Restored script %s to %s", path, info.Mode)
+	return storeContained(contained)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"eximmon/exim"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScriptAttach(t *testing.T) {
+	tests := []struct {
+		name      string
+		cwd       exim.LogEntry
+		arrival   exim.LogEntry
+		want      string
+		wantExact bool
+	}{
+		{
+			name:      "absolute header path",
+			cwd:       exim.LogEntry{PID: "1", Cwd: "/home/u/public_html"},
+			arrival:   exim.LogEntry{PID: "2", OriginatingScript: "1001:/home/u/public_html/inc/mailer.php"},
+			want:      "/home/u/public_html/inc/mailer.php",
+			wantExact: true,
+		},
+		{
+			name:      "relative name under the cwd of the same pid",
+			cwd:       exim.LogEntry{PID: "7", Cwd: "/home/u/public_html/shop"},
+			arrival:   exim.LogEntry{PID: "7", OriginatingScript: "1001:lib/send.php"},
+			want:      "/home/u/public_html/shop/lib/send.php",
+			wantExact: true,
+		},
+		{
+			name:    "relative name under the cwd of another submission",
+			cwd:     exim.LogEntry{PID: "7", Cwd: "/home/u/public_html/shop"},
+			arrival: exim.LogEntry{PID: "8", OriginatingScript: "1001:send.php"},
+			want:    "/home/u/public_html/shop/send.php",
+		},
+		{
+			name:    "relative name without pids",
+			cwd:     exim.LogEntry{Cwd: "/home/u/public_html"},
+			arrival: exim.LogEntry{PHPScript: "example.com/contact/form.php"},
+			want:    "/home/u/public_html/form.php",
+		},
+		{
+			name:    "no script logged",
+			cwd:     exim.LogEntry{PID: "3", Cwd: "/home/u/public_html"},
+			arrival: exim.LogEntry{PID: "3"},
+			want:    "/home/u/public_html",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := &scriptTracker{byPID: map[string]string{}}
+			tracker.seen(tt.cwd)
+			got, exact := tracker.attach(tt.arrival)
+			if got != tt.want || exact != tt.wantExact {
+				t.Errorf("attach = %q %v, want %q %v", got, exact, tt.want, tt.wantExact)
+			}
+		})
+	}
+}
+
+func TestContainScript(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := containedPath
+	containedPath = filepath.Join(dir, ".contained")
+	t.Cleanup(func() { containedPath = oldPath })
+
+	script := filepath.Join(dir, "mailer.php")
+	if err := os.WriteFile(script, []byte("<?php"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := containScript(script, "a@example.com"); err != nil {
+		t.Fatalf("containScript: %v", err)
+	}
+	if fi, _ := os.Stat(script); fi.Mode().Perm() != 0 {
+		t.Errorf("mode after containScript = %s", fi.Mode().Perm())
+	}
+	contained, err := loadContained()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contained[script].Mode != 0640 || contained[script].Sender != "a@example.com" {
+		t.Errorf("record = %+v", contained[script])
+	}
+
+	if err := uncontainScript(script); err != nil {
+		t.Fatalf("uncontainScript: %v", err)
+	}
+	if fi, _ := os.Stat(script); fi.Mode().Perm() != 0640 {
+		t.Errorf("mode after uncontainScript = %s", fi.Mode().Perm())
+	}
+	if contained, _ := loadContained(); len(contained) != 0 {
+		t.Errorf("records left: %v", contained)
+	}
+
+	// nothing is changed when the record cannot be saved
+	containedPath = filepath.Join(dir, "missing", ".contained")
+	if err := containScript(script, "a@example.com"); err == nil {
+		t.Errorf("containScript without a place for its record did not fail")
+	}
+	if fi, _ := os.Stat(script); fi.Mode().Perm() != 0640 {
+		t.Errorf("mode after a failed containScript = %s", fi.Mode().Perm())
+	}
+}
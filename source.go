@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log source types, selected with LOG_SOURCE
+const (
+	sourceFile     = "file"
+	sourceStdin    = "stdin"
+	sourceJournald = "journald"
+)
+
+// LogSource yields exim log lines to the scanner
+type LogSource interface {
+	// ReadLine returns the next line, or io.EOF when no line is available yet
+	ReadLine() (string, error)
+	// Wait blocks until more lines may be available. It reports whether the
+	// source started over, e.g. after logrotate, and returns io.EOF once the
+	// source has ended for good.
+	Wait() (bool, error)
+	// Cursor is the position to store after the last line read, an empty
+	// cursor is never stored
+	Cursor(prefix string) logCursor
+	LineNo() int64
+	Close() error
+}
+
+// streamLine is a line read from a stream, with its journal cursor if any
+type streamLine struct {
+	text   string
+	cursor string
+}
+
+// streamSource turns a blocking reader (stdin, journalctl) into a LogSource,
+// reading in a goroutine so the scanner can tell when it has caught up
+type streamSource struct {
+	lines   chan streamLine
+	pending *streamLine
+	err     error
+	done    bool
+	lineNo  int64
+	cursor  string
+	closer  func() error
+}
+
+// newStreamSource runs produce in the background, every emitted line is
+// handed to the scanner in order
+func newStreamSource(produce func(emit func(text string, cursor string)) error, closer func() error) *streamSource {
+	s := &streamSource{
+		lines:  make(chan streamLine, 1024),
+		closer: closer,
+	}
+
+	go func() {
+		err := produce(func(text string, cursor string) {
+			s.lines <- streamLine{text: text, cursor: cursor}
+		})
+		if err != nil && err != io.EOF {
+			s.err = err
+		}
+		close(s.lines)
+	}()
+
+	return s
+}
+
+// newStdinSource reads piped log lines, e.g. zcat exim_mainlog.gz | eximmon ...
+func newStdinSource() *streamSource {
+	return newStreamSource(func(emit func(string, string)) error {
+		reader := bufio.NewReaderSize(os.Stdin, 64*1024)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				emit(strings.TrimRight(line, "\r\n"), "")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}, func() error { return nil })
+}
+
+func (s *streamSource) ReadLine() (string, error) {
+	line := s.pending
+	s.pending = nil
+
+	if line == nil {
+		select {
+		case l, ok := <-s.lines:
+			if !ok {
+				s.done = true
+				return "", io.EOF
+			}
+			line = &l
+		default:
+			return "", io.EOF
+		}
+	}
+
+	s.lineNo++
+	if line.cursor != "" {
+		s.cursor = line.cursor
+	}
+	return line.text, nil
+}
+
+func (s *streamSource) Wait() (bool, error) {
+	if s.done {
+		if s.err != nil {
+			return false, s.err
+		}
+		return false, io.EOF
+	}
+
+	select {
+	case l, ok := <-s.lines:
+		if !ok {
+			s.done = true
+			return false, nil
+		}
+		s.pending = &l
+	case <-time.After(followWait):
+	}
+	return false, nil
+}
+
+func (s *streamSource) Cursor(prefix string) logCursor {
+	if s.cursor == "" {
+		return logCursor{}
+	}
+	return logCursor{Journal: s.cursor, Line: s.lineNo, Prefix: prefix}
+}
+
+func (s *streamSource) LineNo() int64 {
+	return s.lineNo
+}
+
+func (s *streamSource) Close() error {
+	return s.closer()
+}
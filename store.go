@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// countersPath is the database holding every counter, a bucket per sender
+// with a bucket per date, replacing the data/ tree of one file per counter.
+// Buckets are named by the sender key and 2006-01-02 date as they are, which
+// unlike cleanPath keeps john-doe@example.com and john_doe@example.com apart.
+// Counting happens in memory, the database is a snapshot of countersLogPath.
+var countersPath = "counters.db"
+
+// counterID addresses a counter by its sender bucket, date bucket and key
+type counterID struct {
+	owner string
+	date  string
+	key   string
+}
+
+var (
+	countersMu sync.Mutex
+	countersDB *bolt.DB
+
+	// counterValues caches counters read and holds those counted since the
+	// last snapshot, counterPending are the ones not committed with a cursor
+	// yet and counterUnsaved the committed ones not in the database yet
+	counterValues  = map[counterID]int64{}
+	counterPending = map[counterID]bool{}
+	counterUnsaved = map[counterID]int64{}
+)
+
+// counters opens the counter database on first use. It stays open until
+// releaseCounters, other eximmon commands can open it in between.
+func counters() (*bolt.DB, error) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return openCounters()
+}
+
+// openCounters opens the counter database, countersMu must be held
+func openCounters() (*bolt.DB, error) {
+	if countersDB != nil {
+		return countersDB, nil
+	}
+	db, err := bolt.Open(countersPath, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %v", countersPath, err)
+	}
+	countersDB = db
+	return db, nil
+}
+
+// counterHold is how long a following scanner keeps the counter database open
+// after catching up with the log. Other eximmon commands wait up to 10s for it.
+var counterHold = 5 * time.Second
+
+var releaseTimer *time.Timer
+
+// releaseCountersLater closes the counter database counterHold from now,
+// instead of reopening it each time the scanner catches up
+func releaseCountersLater() {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	if releaseTimer != nil || countersDB == nil {
+		return
+	}
+	releaseTimer = time.AfterFunc(counterHold, func() {
+		countersMu.Lock()
+		defer countersMu.Unlock()
+		releaseTimer = nil
+		if err := closeCountersDB(); err != nil {
+			log("Unable to close %s: %+v", countersPath, err)
+		}
+	})
+}
+
+// releaseCounters closes the counter database
+func releaseCounters() error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return closeCountersDB()
+}
+
+// closeCountersDB is releaseCounters, countersMu must be held
+func closeCountersDB() error {
+	if countersDB == nil {
+		return nil
+	}
+	err := countersDB.Close()
+	countersDB = nil
+	return err
+}
+
+// counterBatch saves the committed counters, then runs fn in the same write
+// transaction for maintenance such as pruning. Counting and releaseCounters
+// wait until it is done.
+func counterBatch(fn func(tx *bolt.Tx) error) error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return batchCounters(fn)
+}
+
+// batchCounters is counterBatch, countersMu must be held
+func batchCounters(fn func(tx *bolt.Tx) error) error {
+	db, err := openCounters()
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for id, count := range counterUnsaved {
+			if err := counterPut(tx, id, count); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	return counterSaved()
+}
+
+// dayKey holds the daily rollup of a date once its hour counters are pruned,
+// e.g. day.rcpt
+const dayKey = "day"
+
+// counterNames returns the hour and minute counters of email at thetime
+func counterNames(thetime time.Time, email string, suffix string) (counterID, counterID) {
+	date := thetime.Format("2006-01-02")
+	return counterID{email, date, thetime.Format("15") + suffix},
+		counterID{email, date, thetime.Format("1504") + suffix}
+}
+
+// counterGet reads a counter from the database, zero when it is missing
+func counterGet(tx *bolt.Tx, id counterID) (int64, error) {
+	ownerBucket := tx.Bucket([]byte(id.owner))
+	if ownerBucket == nil {
+		return 0, nil
+	}
+	dateBucket := ownerBucket.Bucket([]byte(id.date))
+	if dateBucket == nil {
+		return 0, nil
+	}
+	v := dateBucket.Get([]byte(id.key))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(v), 10, 64)
+}
+
+// counterPut writes a counter to the database
+func counterPut(tx *bolt.Tx, id counterID, count int64) error {
+	ownerBucket, err := tx.CreateBucketIfNotExists([]byte(id.owner))
+	if err != nil {
+		return err
+	}
+	dateBucket, err := ownerBucket.CreateBucketIfNotExists([]byte(id.date))
+	if err != nil {
+		return err
+	}
+	return dateBucket.Put([]byte(id.key), []byte(strconv.FormatInt(count, 10)))
+}
+
+// counterMemory returns a counter counted since the last snapshot, countersMu must be held
+func counterMemory(id counterID) (int64, bool) {
+	if count, ok := counterValues[id]; ok {
+		return count, true
+	}
+	count, ok := counterUnsaved[id]
+	return count, ok
+}
+
+// storedCounter returns a counter from memory or tx, countersMu must be held
+func storedCounter(tx *bolt.Tx, id counterID) (int64, error) {
+	if count, ok := counterMemory(id); ok {
+		return count, nil
+	}
+	return counterGet(tx, id)
+}
+
+// counterValue returns a counter from memory, or reads and caches it, countersMu must be held
+func counterValue(id counterID) (int64, error) {
+	if count, ok := counterMemory(id); ok {
+		return count, nil
+	}
+	db, err := openCounters()
+	if err != nil {
+		return 0, err
+	}
+
+	count := int64(0)
+	err = db.View(func(tx *bolt.Tx) error {
+		count, err = counterGet(tx, id)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	counterValues[id] = count
+	return count, nil
+}
+
+func counterStore(thetime time.Time, email string, suffix string, hourCount int64, minCount int64) error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	hour, min := counterNames(thetime, email, suffix)
+	debugLog("Writing %s/%s/%s", min.owner, min.date, min.key)
+	for id, count := range map[counterID]int64{hour: hourCount, min: minCount} {
+		if err := logCounter(id, count); err != nil {
+			return err
+		}
+		counterValues[id] = count
+		counterPending[id] = true
+	}
+	return nil
+}
+
+// this minute, this hour count
+func counterRead(thetime time.Time, email string, suffix string) (int64, int64, error) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	hour, min := counterNames(thetime, email, suffix)
+	hourCount, err := counterValue(hour)
+	if err != nil {
+		return 0, 0, err
+	}
+	minCount, err := counterValue(min)
+	if err != nil {
+		return 0, 0, err
+	}
+	return minCount, hourCount, nil
+}
+
+// counterSum adds up the hour counters and daily rollups of key from the date
+// of from to the date of to
+func counterSum(from time.Time, to time.Time, key string, suffix string) (int64, error) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	db, err := openCounters()
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	err = db.View(func(tx *bolt.Tx) error {
+		last := to.Format("2006-01-02")
+		for day := from; day.Format("2006-01-02") <= last; day = day.AddDate(0, 0, 1) {
+			ids := []counterID{{key, day.Format("2006-01-02"), dayKey + suffix}}
+			for hour := 0; hour < 24; hour++ {
+				ids = append(ids, counterID{ids[0].owner, ids[0].date, fmt.Sprintf("%02d", hour) + suffix})
+			}
+			for _, id := range ids {
+				count, err := storedCounter(tx, id)
+				if err != nil {
+					return err
+				}
+				total += count
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+// counterOwners returns the senders ending in suffix, e.g. @example.com,
+// that have counters on the date of day. Case is ignored.
+func counterOwners(day time.Time, suffix string) ([]string, error) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	date := day.Format("2006-01-02")
+	suffix = strings.ToLower(suffix)
+	found := map[string]bool{}
+	for _, counters := range []map[counterID]int64{counterValues, counterUnsaved} {
+		for id := range counters {
+			if id.date == date && strings.HasSuffix(strings.ToLower(id.owner), suffix) {
+				found[id.owner] = true
+			}
+		}
+	}
+
+	db, err := openCounters()
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(owner []byte, ownerBucket *bolt.Bucket) error {
+			if strings.HasSuffix(strings.ToLower(string(owner)), suffix) && ownerBucket.Bucket([]byte(date)) != nil {
+				found[string(owner)] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make([]string, 0, len(found))
+	for owner := range found {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// migrateDataTree imports the counters of the data/<sender>/<date>/<counter>
+// files of earlier versions. The tree is then renamed to data.migrated so it
+// is not imported twice, and left for the admin to remove.
+func migrateDataTree(path string) error {
+	path = filepath.Clean(path)
+	db, err := counters()
+	if err != nil {
+		return err
+	}
+
+	owners, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		log("Nothing to migrate, %s not found", path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	imported := 0
+	for _, owner := range owners {
+		if !owner.IsDir() {
+			continue
+		}
+		ownerDir := filepath.Join(path, owner.Name())
+		dates, err := os.ReadDir(ownerDir)
+		if err != nil {
+			return err
+		}
+
+		// a transaction per sender keeps memory low on large trees
+		err = db.Update(func(tx *bolt.Tx) error {
+			ownerBucket, err := tx.CreateBucketIfNotExists([]byte(owner.Name()))
+			if err != nil {
+				return err
+			}
+			for _, date := range dates {
+				if !date.IsDir() {
+					continue
+				}
+				if _, err := time.Parse("2006_01_02", date.Name()); err != nil {
+					log("Skipping %s: not a date", filepath.Join(ownerDir, date.Name()))
+					continue
+				}
+				dateBucket, err := ownerBucket.CreateBucketIfNotExists([]byte(date.Name()))
+				if err != nil {
+					return err
+				}
+
+				dateDir := filepath.Join(ownerDir, date.Name())
+				files, err := os.ReadDir(dateDir)
+				if err != nil {
+					return err
+				}
+				for _, file := range files {
+					content, err := os.ReadFile(filepath.Join(dateDir, file.Name()))
+					if err != nil {
+						return err
+					}
+					count, err := strconv.ParseInt(string(content), 0, 64)
+					if err != nil {
+						log("Skipping %s: %v", filepath.Join(dateDir, file.Name()), err)
+						continue
+					}
+					if err := dateBucket.Put([]byte(file.Name()), []byte(strconv.FormatInt(count, 10))); err != nil {
+						return err
+					}
+					imported++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		debugLog("Migrated %s", ownerDir)
+	}
+
+	log("Imported %d counters of %d senders from %s into %s", imported, len(owners), path, countersPath)
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return err
+	}
+	log("Renamed %s to %s.migrated, it is no longer used and can be removed", path, path)
+	return nil
+}
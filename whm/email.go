@@ -262,7 +262,14 @@ func SuspendAccountByEmail(email string) error {
 		return err
 	}
 
-	urlString := apiURI + "suspend_outgoing_email?api.version=1&user=" + url.QueryEscape(info.User)
+	return SuspendUser(info.User)
+}
+
+// SuspendUser suspends outgoing email for a whole cPanel account
+func SuspendUser(user string) error {
+	Log("Suspending user: %s", user)
+
+	urlString := apiURI + "suspend_outgoing_email?api.version=1&user=" + url.QueryEscape(user)
 	conn, err := WHMDialer()
 	if err != nil {
 		return err
@@ -316,7 +323,14 @@ func UnsuspendAccountByEmail(email string) error {
 		return err
 	}
 
-	urlString := apiURI + "unsuspend_outgoing_email?api.version=1&user=" + url.QueryEscape(info.User)
+	return UnsuspendUser(info.User)
+}
+
+// UnsuspendUser unsuspends outgoing email for a whole cPanel account
+func UnsuspendUser(user string) error {
+	Log("Unsuspending user: %s", user)
+
+	urlString := apiURI + "unsuspend_outgoing_email?api.version=1&user=" + url.QueryEscape(user)
 	conn, err := WHMDialer()
 	if err != nil {
 		return err